@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// PeerResult is the outcome of testing against one peer server
+type PeerResult struct {
+	Peer    string  `json:"peer"`
+	Server  string  `json:"server,omitempty"`
+	Average float64 `json:"average"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Unit    string  `json:"unit,omitempty"` // Unit reported by the peer, which may differ from this server's
+	// Time to establish the TCP connection, a high value points at ARP or switch issues
+	ConnectMs float64 `json:"connectMs,omitempty"`
+	// Jitter of data arrival, with -measure-jitter
+	DataJitter float64 `json:"dataJitter,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// splitPeers parses a comma-separated list of peer addresses
+func splitPeers(list string) []string {
+	var peers []string
+	for _, peer := range strings.Split(list, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// checkPeers reports the first of peers that isn't one of the configured
+// peers. Clients may only have the server test those, or they could make it
+// connect to any host and port, and probe them through the errors returned.
+func (c *Config) checkPeers(peers []string) error {
+	allowed := splitPeers(c.Peers)
+	for _, peer := range peers {
+		if !slices.Contains(allowed, peer) {
+			return fmt.Errorf("%s is not one of the configured -peers", peer)
+		}
+	}
+	return nil
+}
+
+// testPeers runs a test against every peer using a bounded number of
+// concurrent workers, returning results in the order peers were given
+func testPeers(ctx context.Context, cfg *Config, peers []string) []PeerResult {
+	results := make([]PeerResult, len(peers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(cfg.AggregateWorkers, len(peers)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = testPeer(ctx, cfg, peers[i])
+			}
+		}()
+	}
+	for i := range peers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// testPeer runs one test against the server at peer within PeerTimeout
+func testPeer(ctx context.Context, cfg *Config, peer string) PeerResult {
+	ctx, cancel := context.WithTimeout(ctx, cfg.PeerTimeout)
+	defer cancel()
+
+	result := PeerResult{Peer: peer}
+	final, err := runClientTest(ctx, newTestClient(cfg, "tcp", ""), "ws://"+peer+"/ws", peerTestDuration)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Server = final.Server
+	result.Average = final.Average
+	result.Min = final.Min
+	result.Max = final.Max
+	result.Unit = final.Unit
+	result.ConnectMs = durationMs(final.ConnectTime)
+	result.DataJitter = final.DataJitter
+	return result
+}
+
+// handleAggregate tests every peer named in the peers query parameter, which
+// may only name configured peers, or all configured peers when it is absent,
+// and responds with the per-peer results
+func (s *server) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	peers := splitPeers(r.URL.Query().Get("peers"))
+	if err := cfg.checkPeers(peers); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "unknown_peer", err.Error())
+		return
+	}
+	if len(peers) == 0 {
+		peers = splitPeers(cfg.Peers)
+	}
+	if len(peers) == 0 {
+		writeJSONError(w, r, http.StatusBadRequest, "no_peers", "no peers given")
+		return
+	}
+
+	writeJSON(w, testPeers(r.Context(), cfg, peers))
+}
+
+// runSweep tests targets one after another on behalf of the client of conn,
+// as /api/aggregate tests peers, sending a "target" message with each
+// result and a "sweep" message with all of them. A target that fails is
+// reported with its error and the sweep moves on to the next. Cancelling
+// ctx skips the remaining targets.
+func runSweep(ctx context.Context, conn testSink, cfg *Config, id string, targets []string) {
+	defer recoverTest(conn, id)
+	results := make([]PeerResult, 0, len(targets))
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		result := testPeer(ctx, cfg, target)
+		results = append(results, result)
+		if err := conn.sendJSON(SpeedTestMessage{Type: "target", ID: id, Target: &result}); err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+	}
+	sweep := SpeedTestMessage{Type: "sweep", ID: id, Results: results, Stopped: ctx.Err() != nil}
+	if err := conn.sendJSON(sweep); err != nil {
+		log.Printf("Write error: %v", err)
+	}
+}
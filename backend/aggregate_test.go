@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepRejectsUnlistedTargets(t *testing.T) {
+	cfg := testConfig()
+	cfg.Peers = "127.0.0.1:1"
+	conn := dialTest(t, startServer(t, cfg))
+	if err := conn.WriteJSON(SpeedTestMessage{Type: "start", Targets: []string{"127.0.0.1:1", "127.0.0.1:22"}}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readUntil(t, conn, "error")
+	if got := msgs[len(msgs)-1].Error; !strings.Contains(got, "127.0.0.1:22 is not one of the configured -peers") {
+		t.Errorf("got error %q", got)
+	}
+}
+
+func TestSweepCountsAsActiveTest(t *testing.T) {
+	peer := startServer(t, testConfig())
+	cfg := testConfig()
+	cfg.Peers = peer
+	cfg.MaxActiveTests = 1
+	addr := startServer(t, cfg)
+	sweeper, other := dialTest(t, addr), dialTest(t, addr)
+
+	if err := sweeper.WriteJSON(SpeedTestMessage{Type: "start", Targets: []string{peer}}); err != nil {
+		t.Fatal(err)
+	}
+	runningTest(t)
+	if err := other.WriteJSON(SpeedTestMessage{Type: "start", Duration: 1}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readUntil(t, other, "error")
+	if got := msgs[len(msgs)-1].Error; got != "server busy, try again later" {
+		t.Errorf("start during a sweep got error %q", got)
+	}
+
+	msgs = readUntil(t, sweeper, "sweep")
+	if results := msgs[len(msgs)-1].Results; len(results) != 1 || results[0].Error != "" {
+		t.Errorf("sweep results %+v, want one successful result", results)
+	}
+	for i := 0; activeTests.count() != 0; i++ {
+		if i == 500 {
+			t.Fatal("sweep still registered 5s after it ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAggregateRejectsUnlistedPeers(t *testing.T) {
+	cfg := testConfig()
+	cfg.Peers = "127.0.0.1:1"
+	addr := startServer(t, cfg)
+
+	resp, err := http.Get("http://" + addr + "/api/aggregate?peers=127.0.0.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var apiErr APIError
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || apiErr.Code != "unknown_peer" {
+		t.Errorf("got %s with code %q, want 400 unknown_peer", resp.Status, apiErr.Code)
+	}
+}
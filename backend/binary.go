@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Speed samples of tests started with "binary": true are sent as small
+// binary WebSocket messages instead of JSON "speed" messages, which matters
+// when long tests sample often. Layout, little-endian:
+//
+//	0  4  magic "LSTS"
+//	4  8  speed in the server's unit, float64
+//	12 4  ETA in milliseconds, uint32, 0 for continuous tests
+//
+// Test data is also sent as binary messages, so chunks of binary tests are
+// never as short as a sample.
+const binarySampleSize = 16
+
+var binarySampleMagic = [4]byte{'L', 'S', 'T', 'S'}
+
+// encodeSample encodes the speed and ETA of a "speed" message
+func (m SpeedTestMessage) encodeSample() []byte {
+	b := make([]byte, binarySampleSize)
+	copy(b, binarySampleMagic[:])
+	binary.LittleEndian.PutUint64(b[4:], math.Float64bits(m.Speed))
+	binary.LittleEndian.PutUint32(b[12:], uint32(min(m.EtaSeconds*1000, math.MaxUint32)))
+	return b
+}
+
+// decodeSample decodes a binary sample into a "speed" message, reporting
+// false if b isn't one
+func decodeSample(b []byte) (SpeedTestMessage, bool) {
+	if len(b) != binarySampleSize || [4]byte(b[:4]) != binarySampleMagic {
+		return SpeedTestMessage{}, false
+	}
+	return SpeedTestMessage{
+		Type:       "speed",
+		Speed:      math.Float64frombits(binary.LittleEndian.Uint64(b[4:])),
+		EtaSeconds: float64(binary.LittleEndian.Uint32(b[12:])) / 1000,
+	}, true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// burstWindow is the span over which burst tests measure instantaneous speed
+const burstWindow = 100 * time.Millisecond
+
+// peakMeter measures the speed of writes over consecutive windows of
+// burstWindow and keeps the highest, which an average over a whole chunk
+// smooths away. It is only used by the goroutine running the test.
+type peakMeter struct {
+	cfg         *Config
+	w           io.Writer
+	windowStart time.Time
+	windowBytes int64
+	peak        float64 // Mbps
+}
+
+// wrap returns a writer that measures writes to w. Windows restart with
+// every chunk so the pauses between chunks don't count as idle time.
+func (m *peakMeter) wrap(w io.Writer) io.Writer {
+	m.w = w
+	m.windowStart = time.Now()
+	m.windowBytes = 0
+	return m
+}
+
+func (m *peakMeter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	m.windowBytes += int64(n)
+	if elapsed := time.Since(m.windowStart); elapsed >= burstWindow {
+		m.peak = max(m.peak, m.cfg.plausibleSpeed(measureSpeed(m.windowBytes, elapsed)))
+		m.windowStart = time.Now()
+		m.windowBytes = 0
+	}
+	return n, err
+}
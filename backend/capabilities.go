@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Capabilities describes what a server supports and the limits it applies,
+// so clients can offer only what will work. It is the response to
+// /api/capabilities and is sent in reply to a "hello" message.
+type Capabilities struct {
+	Version int    `json:"version"` // protocolVersion
+	Server  string `json:"server"`
+
+	// Directions a test can measure and how: "download" over the WebSocket,
+	// /events and /download, "upload" over /upload
+	Directions []string `json:"directions"`
+	Transports []string `json:"transports"`
+	Units      []string `json:"units"`
+	Unit       string   `json:"unit"` // Unit of reported speeds
+	// Optional start message features: burst, warmup, stream, continuous, pause, binary, targets, sweep
+	Features []string `json:"features"`
+	TCPInfo  bool     `json:"tcpInfo,omitempty"` // Final results include kernel TCP statistics
+
+	// Limits, omitted when unlimited. Each test is a single stream.
+	MinDuration     int     `json:"minDuration"` // seconds
+	MaxDuration     int     `json:"maxDuration,omitempty"`
+	MaxWarmup       int     `json:"maxWarmup"`
+	ChunkSize       int64   `json:"chunkSize"`
+	MaxChunkSize    int64   `json:"maxChunkSize,omitempty"`
+	MaxPayload      int64   `json:"maxPayload,omitempty"`
+	MaxUpload       int64   `json:"maxUpload"`
+	MaxSessionBytes int64   `json:"maxSessionBytes,omitempty"`
+	MaxActiveTests  int     `json:"maxActiveTests,omitempty"`
+	Throttle        float64 `json:"throttle,omitempty"` // Mbps per connection
+}
+
+// capabilities returns the Capabilities of a server running with c
+func (c *Config) capabilities() Capabilities {
+	units := make([]string, 0, len(unitScales))
+	for unit := range unitScales {
+		units = append(units, unit)
+	}
+	slices.Sort(units)
+	return Capabilities{
+		Version:         protocolVersion,
+		Server:          c.ServerName,
+		Directions:      []string{"download", "upload"},
+		Transports:      []string{"websocket", "events", "http"},
+		Units:           units,
+		Unit:            c.Unit,
+		Features:        []string{"burst", "warmup", "stream", "continuous", "pause", "binary", "targets", "sweep"},
+		TCPInfo:         c.TCPInfo,
+		MinDuration:     c.MinDuration,
+		MaxDuration:     c.MaxDuration,
+		MaxWarmup:       maxWarmup,
+		ChunkSize:       c.ChunkSize,
+		MaxChunkSize:    c.MaxChunkSize,
+		MaxPayload:      c.MaxPayload,
+		MaxUpload:       c.MaxUpload,
+		MaxSessionBytes: c.MaxSessionBytes,
+		MaxActiveTests:  c.MaxActiveTests,
+		Throttle:        c.Throttle,
+	}
+}
+
+// handleCapabilities reports what the server supports
+func (s *server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	writeJSON(w, s.config().capabilities())
+}
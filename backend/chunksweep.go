@@ -0,0 +1,94 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sweepStepDuration is how many seconds each chunk size of a sweep is
+// tested for, raised to MinDuration if that is longer
+const sweepStepDuration = 2
+
+// SweepResult is the headline average of one chunk size in a chunk size sweep
+type SweepResult struct {
+	ChunkSize int64   `json:"chunkSize"`
+	Average   float64 `json:"average"`
+}
+
+// parseChunkSizes parses a comma-separated list of chunk sizes in bytes
+func parseChunkSizes(list string) ([]int64, error) {
+	var sizes []int64
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		size, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid chunk size %q", field)
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no chunk sizes given")
+	}
+	return sizes, nil
+}
+
+// runChunkSweep runs a short test as requested by msg at each of the
+// SweepSizes, one after another, to find the chunk size that suits the
+// client's NIC best. Each test sends its usual messages, followed by a
+// "chunk_result" with its average. Once all have run, a "chunk_sweep"
+// lists the results from fastest to slowest. Cancelling ctx or stopping a
+// test ends the sweep without a "chunk_sweep". The session must already
+// have begun a test for the first size.
+func runChunkSweep(ctx context.Context, conn *wsConn, sess *session, msg, defaults SpeedTestMessage) {
+	msg.ID = sanitizeID(msg.ID)
+	defer recoverTest(conn, msg.ID)
+	cfg := sess.cfg
+	sizes, err := parseChunkSizes(cfg.SweepSizes)
+	if err != nil {
+		sess.endTest()
+		abortTest(conn, msg.ID, err.Error())
+		return
+	}
+	msg.Sweep = false
+	msg.Continuous = false
+	msg.Duration = max(sweepStepDuration, cfg.MinDuration)
+
+	results := make([]SweepResult, 0, len(sizes))
+	for i, size := range sizes {
+		if i > 0 && !sess.beginTest() {
+			abortTest(conn, msg.ID, "a test is already running")
+			return
+		}
+		msg.ChunkSize = size
+		speedTest, duration := newTestFromStart(ctx, conn, sess, msg, defaults)
+		if speedTest == nil {
+			sess.endTest()
+			return
+		}
+		final, completed := runSpeedTest(conn, speedTest, duration)
+		if !completed || final.Stopped {
+			return
+		}
+		results = append(results, SweepResult{ChunkSize: speedTest.chunkSize, Average: final.Average})
+		result := SpeedTestMessage{Type: "chunk_result", ID: speedTest.id, ChunkSize: speedTest.chunkSize, Average: final.Average, Unit: cfg.Unit}
+		if err := conn.sendJSON(result); err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+	}
+
+	slices.SortStableFunc(results, func(a, b SweepResult) int {
+		return cmp.Compare(b.Average, a.Average)
+	})
+	sweep := SpeedTestMessage{Type: "chunk_sweep", ID: msg.ID, ChunkSize: results[0].ChunkSize, ChunkSweep: results, Unit: cfg.Unit}
+	if err := conn.sendJSON(sweep); err != nil {
+		log.Printf("Write error: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Wait before reconnecting after a dropped connection, doubling on each
+// further attempt up to the maximum
+const (
+	reconnectBackoff    = time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// errReconnectsExhausted is returned once a test's connection has failed
+// more often than the client may reconnect
+var errReconnectsExhausted = errors.New("connection kept failing")
+
+// runClientCommand implements the client subcommand, which runs tests
+// against a server from the terminal and prints a summary without
+// listening itself
+func runClientCommand(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Server address (a socket path with -network unix)")
+	clientNetwork := fs.String("network", "tcp", "Network the server listens on: tcp or unix")
+	duration := fs.Int("duration", defaultDuration, "Test duration in seconds")
+	runs := fs.Int("runs", 1, "Number of tests to run one after another")
+	reconnectAttempts := fs.Int("reconnect-attempts", 3, "Times to reconnect and start a fresh test when a run's connection drops, with exponential backoff (0 gives up at once)")
+	var cfg Config
+	fs.StringVar(&cfg.Token, "token", "", "Bearer token for servers started with -token")
+	fs.DurationVar(&cfg.DialTimeout, "dial-timeout", 5*time.Second, "Time limit for connecting to the server")
+	fs.DurationVar(&cfg.TCPKeepAlive, "tcp-keepalive", 0, "TCP keepalive period (0 keeps the default, negative disables)")
+	fs.BoolVar(&cfg.MeasureJitter, "measure-jitter", false, "Report the jitter of data arrival, timing every read")
+	fs.IntVar(&cfg.ReadBuffer, "read-buffer", defaultReadBuffer, "Bytes read at a time from test data")
+	binary := fs.Bool("binary", false, "Receive samples as compact binary messages instead of JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *runs < 1 {
+		return errors.New("-runs must be at least 1")
+	}
+	if *reconnectAttempts < 0 {
+		return errors.New("-reconnect-attempts must not be negative")
+	}
+
+	hostPort := *addr
+	if *clientNetwork == "unix" {
+		hostPort = "localhost"
+	}
+	client := newTestClient(&cfg, *clientNetwork, *addr)
+	client.binary = *binary
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	averages := newSampleRing(*runs)
+	var unit string
+	for i := range *runs {
+		result, reconnects, err := runReconnecting(ctx, client, "ws://"+hostPort+"/ws", *duration, *reconnectAttempts, i+1)
+		if err != nil {
+			return err
+		}
+		if reconnects > 0 {
+			fmt.Printf("--- Run %d, fresh test after reconnect %d ---\n", i+1, reconnects)
+		}
+		unit = unitLabels[result.Unit]
+		averages.add(result.Average)
+		fmt.Printf("Run %d: average %.2f %s (min %.2f, max %.2f), latency %.2f ms, bufferbloat %.2f ms, connect %.2f ms%s\n",
+			i+1, result.Average, unit, result.Min, result.Max, result.LatencyMs, result.BufferbloatMs, durationMs(result.ConnectTime), result.jitterText())
+	}
+	if *runs > 1 {
+		fmt.Printf("Summary: %d runs, mean %.2f %s (worst %.2f, best %.2f)\n",
+			averages.count, averages.mean(), unit, averages.min, averages.max)
+	}
+	return nil
+}
+
+// runReconnecting runs a test like runClientTest. When the connection fails
+// it logs the interruption, waits with exponential backoff and starts a
+// fresh test, at most attempts times. It returns the result with the number
+// of reconnects it took. Errors reported by the server and interrupts end
+// it without reconnecting.
+func runReconnecting(ctx context.Context, client *testClient, url string, duration, attempts, run int) (clientResult, int, error) {
+	backoff := reconnectBackoff
+	for reconnects := 0; ; reconnects++ {
+		result, err := runClientTest(ctx, client, url, duration)
+		var rejected serverError
+		if err == nil || ctx.Err() != nil || errors.As(err, &rejected) {
+			return result, reconnects, err
+		}
+		if reconnects == attempts {
+			return result, reconnects, fmt.Errorf("%w after %d reconnects: %w", errReconnectsExhausted, reconnects, err)
+		}
+		log.Printf("Run %d interrupted: %v, reconnecting in %v (attempt %d of %d)", run, err, backoff, reconnects+1, attempts)
+		select {
+		case <-ctx.Done():
+			return result, reconnects, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+}
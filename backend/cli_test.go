@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReconnectAfterDroppedConnection(t *testing.T) {
+	cfg := testConfig()
+	handler := newServer(cfg).handler()
+	// The first connection is dropped before its test begins
+	var requests atomic.Int32
+	drop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: drop}
+	go server.Serve(listener)
+	defer server.Close()
+
+	url := "ws://" + listener.Addr().String() + "/ws"
+	result, reconnects, err := runReconnecting(context.Background(), newTestClient(cfg, "tcp", ""), url, 1, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconnects != 1 || result.Type != "final" {
+		t.Errorf("got %q after %d reconnects, want a final after 1", result.Type, reconnects)
+	}
+}
+
+func TestReconnectsExhausted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close() // Nothing listens, so every dial fails
+
+	_, _, err = runReconnecting(context.Background(), newTestClient(testConfig(), "tcp", ""), "ws://"+addr+"/ws", 1, 0, 1)
+	if !errors.Is(err, errReconnectsExhausted) {
+		t.Errorf("got error %v, want errReconnectsExhausted", err)
+	}
+}
+
+func TestClientCommandRejectsInvalidRuns(t *testing.T) {
+	for _, runs := range []string{"0", "-2"} {
+		if err := runClientCommand([]string{"-runs", runs}); err == nil || !strings.Contains(err.Error(), "-runs") {
+			t.Errorf("-runs %s got error %v", runs, err)
+		}
+	}
+}
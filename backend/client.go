@@ -0,0 +1,262 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// localHostPort returns the host:port for reaching a server listening on addr from this host
+func localHostPort(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// defaultReadBuffer is how many bytes a client reads at a time by default.
+// Chunks of several megabytes arrive just as fast read in smaller pieces,
+// which keeps memory per stream low.
+const defaultReadBuffer = 256 * 1024
+
+// testClient holds the WebSocket and HTTP clients used to reach a server
+type testClient struct {
+	dialer     *websocket.Dialer
+	http       *http.Client
+	token      string // Bearer token sent to servers requiring one
+	binary     bool   // Ask for samples as binary messages
+	readBuffer int    // Bytes read at a time from test data
+}
+
+// newTestClient returns a client for a server listening on network, using
+// the dial, TCP and token settings of cfg. For "unix" every connection
+// dials the socket at addr, so URLs only need a placeholder host.
+func newTestClient(cfg *Config, network, addr string) *testClient {
+	d := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.TCPKeepAlive}
+	if cfg.Congestion != "" {
+		d.Control = func(_, _ string, c syscall.RawConn) error {
+			warnCongestion(cfg.Congestion, setCongestion(c, cfg.Congestion))
+			return nil
+		}
+	}
+	dial := d.DialContext
+	if network == "unix" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", addr)
+		}
+	}
+	wsDial := dial
+	if cfg.MeasureJitter {
+		wsDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &gapConn{Conn: conn, gaps: newSampleRing(1)}, nil
+		}
+	}
+	return &testClient{
+		dialer:     &websocket.Dialer{NetDialContext: wsDial},
+		http:       &http.Client{Transport: &http.Transport{DialContext: dial}},
+		token:      cfg.Token,
+		readBuffer: cmp.Or(cfg.ReadBuffer, defaultReadBuffer),
+	}
+}
+
+// clientResult is the outcome of a test run by runClientTest
+type clientResult struct {
+	SpeedTestMessage               // Final message from the server
+	ConnectTime      time.Duration // Time to establish the TCP connection, not part of throughput
+
+	// Standard deviation in ms of the gaps between reads of test data, with
+	// -measure-jitter. High values point at queueing, such as a misbehaving
+	// QoS policy, even when throughput looks fine.
+	DataJitter float64
+}
+
+// jitterText formats DataJitter for printing after the other results, or
+// returns nothing when it wasn't measured
+func (r clientResult) jitterText() string {
+	if r.DataJitter == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", data jitter %.3f ms", r.DataJitter)
+}
+
+// gapConn records the gaps between successive reads that return data
+// while a chunk of test data is being read, so the server's pauses between
+// chunks don't count. It is only used by the goroutine reading the WebSocket.
+type gapConn struct {
+	net.Conn
+	timing bool
+	last   time.Time // Time of the last read while timing
+	gaps   sampleRing
+}
+
+func (c *gapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.timing {
+		now := time.Now()
+		c.gaps.add(durationMs(now.Sub(c.last)))
+		c.last = now
+	}
+	return n, err
+}
+
+// startTiming begins timing reads. It is safe to call on a nil gapConn.
+func (c *gapConn) startTiming() {
+	if c != nil {
+		c.timing = true
+		c.last = time.Now()
+	}
+}
+
+// stopTiming stops timing reads. It is safe to call on a nil gapConn.
+func (c *gapConn) stopTiming() {
+	if c != nil {
+		c.timing = false
+	}
+}
+
+// runClientTest runs one test against the WebSocket server at url and
+// returns its final message. Cancelling ctx aborts the dial or the test.
+func runClientTest(ctx context.Context, tc *testClient, url string, duration int) (clientResult, error) {
+	var result clientResult
+	var connectStart time.Time
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { connectStart = time.Now() },
+		GotConn: func(httptrace.GotConnInfo) { result.ConnectTime = time.Since(connectStart) },
+	}
+	var header http.Header
+	if tc.token != "" {
+		header = http.Header{"Authorization": {"Bearer " + tc.token}}
+	}
+	conn, _, err := tc.dialer.DialContext(httptrace.WithClientTrace(ctx, trace), url, header)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	gaps, _ := conn.UnderlyingConn().(*gapConn)
+
+	start := SpeedTestMessage{Type: "start", Version: protocolVersion, Duration: duration, Binary: tc.binary}
+	if err := conn.WriteJSON(start); err != nil {
+		return result, err
+	}
+
+	// Allow a generous margin past the test duration for the final message
+	deadline := time.Now().Add(time.Duration(duration)*time.Second + 30*time.Second)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return result, err
+	}
+
+	// Test data is read through one buffer rather than a message at a time,
+	// so memory doesn't grow with the chunk size
+	buf := make([]byte, tc.readBuffer)
+	for {
+		messageType, r, err := conn.NextReader()
+		if err == nil && messageType != websocket.TextMessage {
+			gaps.startTiming()
+			err = discardBinary(r, tc.binary, buf)
+			gaps.stopTiming()
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			return result, err
+		}
+
+		var msg SpeedTestMessage
+		if err := json.NewDecoder(r).Decode(&msg); err != nil {
+			return result, err
+		}
+		switch msg.Type {
+		case "final":
+			result.SpeedTestMessage = msg
+			if gaps != nil {
+				result.DataJitter = gaps.gaps.stdDev()
+			}
+			return result, nil
+		case "error":
+			return result, serverError(msg.Error)
+		}
+	}
+}
+
+// serverError is the reason given by an "error" message from the server,
+// such as a busy server or an invalid request, unlike a failed connection
+type serverError string
+
+func (e serverError) Error() string {
+	return "server error: " + string(e)
+}
+
+// discardBinary reads one binary message, test data or, in binary tests, a
+// sample, which is checked and dropped like a JSON "speed" message. Test
+// data is read into buf, as much as fits at a time.
+func discardBinary(r io.Reader, binarySamples bool, buf []byte) error {
+	head := make([]byte, binarySampleSize+1)
+	n, err := io.ReadFull(r, head)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// The whole message fit in head, which chunks of binary tests never do
+		if _, ok := decodeSample(head[:n]); binarySamples && !ok {
+			return errors.New("malformed binary sample")
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// runHttpDownloadTest downloads url and returns the speed in Mbps of reading the response body
+func runHttpDownloadTest(ctx context.Context, tc *testClient, url string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if tc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+	}
+	start := time.Now()
+	resp, err := tc.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return measureSpeed(n, time.Since(start)), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// BenchmarkReadBuffer reads chunks of test data from a loopback TCP
+// connection with different read buffer sizes, the largest being a whole
+// chunk as when every message was read into memory at once
+func BenchmarkReadBuffer(b *testing.B) {
+	const chunk = 8 * 1024 * 1024
+	for _, size := range []int{16 * 1024, 64 * 1024, defaultReadBuffer, 1024 * 1024, chunk} {
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				data := make([]byte, blockSize)
+				for {
+					if _, err := conn.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			for b.Loop() {
+				buf := make([]byte, size) // Allocated per chunk, as the client allocates per test
+				if err := discardBinary(io.LimitReader(conn, chunk), false, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
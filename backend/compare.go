@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Changes in the average smaller than this percentage are reported as unchanged
+const compareThresholdPct = 5
+
+const maxCompareBody = 1024 * 1024 // bytes
+
+// CompareRequest is the body of /api/compare: two final results, as sent
+// over the WebSocket or written to the results log
+type CompareRequest struct {
+	Baseline *SpeedTestMessage `json:"baseline"`
+	Current  *SpeedTestMessage `json:"current"`
+}
+
+// CompareResult is the response to /api/compare. Deltas are percentages of
+// the baseline and are zero where the baseline has no value.
+type CompareResult struct {
+	AveragePct float64 `json:"averagePct"`
+	MinPct     float64 `json:"minPct"`
+	MaxPct     float64 `json:"maxPct"`
+	LatencyPct float64 `json:"latencyPct"`
+	Verdict    string  `json:"verdict"` // better, worse or unchanged
+}
+
+// percentChange returns the change from baseline to current as a percentage of baseline
+func percentChange(baseline, current float64) float64 {
+	if baseline == 0 {
+		return 0
+	}
+	return (current - baseline) / baseline * 100
+}
+
+// speedsInMbps returns msg with its speeds converted from its unit to Mbps
+func speedsInMbps(msg SpeedTestMessage) SpeedTestMessage {
+	for _, speed := range []*float64{&msg.Average, &msg.Min, &msg.Max, &msg.CILow, &msg.CIHigh} {
+		*speed = toMbps(*speed, msg.Unit)
+	}
+	msg.Unit = unitMbps
+	return msg
+}
+
+// compareResults reports how current differs from baseline. Both are
+// compared in Mbps, whatever unit each was reported in. The verdict follows
+// the average, and is unchanged when the change is within
+// compareThresholdPct or both results' confidence intervals overlap.
+func compareResults(baseline, current SpeedTestMessage) CompareResult {
+	baseline, current = speedsInMbps(baseline), speedsInMbps(current)
+	result := CompareResult{
+		AveragePct: percentChange(baseline.Average, current.Average),
+		MinPct:     percentChange(baseline.Min, current.Min),
+		MaxPct:     percentChange(baseline.Max, current.Max),
+		LatencyPct: percentChange(baseline.LatencyMs, current.LatencyMs),
+		Verdict:    "unchanged",
+	}
+	overlap := baseline.CIHigh > 0 && current.CIHigh > 0 &&
+		baseline.CILow <= current.CIHigh && current.CILow <= baseline.CIHigh
+	switch {
+	case overlap:
+	case result.AveragePct >= compareThresholdPct:
+		result.Verdict = "better"
+	case result.AveragePct <= -compareThresholdPct:
+		result.Verdict = "worse"
+	}
+	return result
+}
+
+// handleCompare compares two results posted by the client
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var req CompareRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCompareBody)).Decode(&req); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_body", "invalid request body")
+		return
+	}
+	if req.Baseline == nil || req.Current == nil {
+		writeJSONError(w, r, http.StatusBadRequest, "missing_result", "baseline and current results are required")
+		return
+	}
+	for _, result := range []*SpeedTestMessage{req.Baseline, req.Current} {
+		if result.Unit == "" {
+			continue
+		}
+		if err := validateUnit(result.Unit); err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid_unit", err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, compareResults(*req.Baseline, *req.Current))
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config holds the settings of one server: the test data it sends, the
+// limits it applies and how it reports results. main fills it from the
+// command line, and everything else is handed a Config instead of reading
+// flags, so differently configured servers can run in one process.
+type Config struct {
+	// Test data
+	ChunkSize     int64 // Bytes per test message unless the client asks otherwise
+	DataMode      string
+	ServeFile     string // Send this file instead of generated data, if set
+	ZeroCopy      bool
+	RecycleRandom time.Duration
+
+	// Limits on sizes clients may request, 0 is unlimited
+	MaxChunkSize int64
+	MaxPayload   int64
+
+	// WebSocket
+	WSCompress     bool
+	WSReadBuffer   int
+	WSWriteBuffer  int
+	MaxMessageSize int64 // Largest message accepted from a client
+
+	// Test limits and statistics
+	MinDuration     int // seconds
+	MaxDuration     int // seconds, 0 is unlimited
+	Warmup          int // seconds
+	Stream          bool
+	MaxSamples      int
+	MaxPlausible    float64 // Mbps, 0 disables
+	FinalMetric     string
+	Unit            string
+	MaxSessionBytes int64   // 0 is unlimited
+	MaxActiveTests  int     // Across all clients, 0 is unlimited
+	SweepSizes      string  // Comma-separated chunk sizes of a sweep
+	Throttle        float64 // Mbps of test data per connection, 0 is unlimited
+	ReferenceSpeed  float64 // Mbps earning a full score
+
+	ServerName string
+
+	// TCP tuning for test connections
+	TCPNoDelay   bool
+	TCPKeepAlive time.Duration
+	TCPInfo      bool
+	Congestion   string
+
+	// Per-packet overhead assumed when estimating throughput on the wire
+	HeaderBytes   int
+	FrameOverhead int
+
+	// Timeouts, 0 disables
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// HTTP test endpoints
+	MaxUpload    int64
+	DownloadGzip bool
+	DebugReads   bool
+
+	// Access control, empty disables
+	AdminToken string
+	Token      string
+
+	// Tests this process runs as a client
+	MeasureJitter bool // Time every read
+	ReadBuffer    int  // Bytes read at a time, independent of the chunk size
+
+	// Aggregate tests against peer servers
+	Peers            string
+	AggregateWorkers int
+	PeerTimeout      time.Duration
+
+	ResultsFile string // Results log read back by /api/history.csv
+	TraceFile   string // Execution trace of the latest test, empty disables
+}
+
+// configFromFlags returns the Config given on the command line
+func configFromFlags() *Config {
+	cfg := &Config{
+		ChunkSize:     int64(*chunkSize),
+		DataMode:      *dataMode,
+		ServeFile:     *serveFile,
+		ZeroCopy:      *zeroCopy,
+		RecycleRandom: *recycleRandom,
+
+		MaxChunkSize: *maxChunkSize,
+		MaxPayload:   *maxPayload,
+
+		WSCompress:     *wsCompress,
+		WSReadBuffer:   *wsReadBuffer,
+		WSWriteBuffer:  *wsWriteBuffer,
+		MaxMessageSize: *maxMessageSize,
+
+		MinDuration:     *minDuration,
+		MaxDuration:     *maxDuration,
+		Warmup:          *warmup,
+		Stream:          *stream,
+		MaxSamples:      *maxSamples,
+		MaxPlausible:    *maxPlausible,
+		FinalMetric:     *finalMetric,
+		Unit:            *speedUnit,
+		MaxSessionBytes: *maxSessionBytes,
+		MaxActiveTests:  *maxActiveTests,
+		SweepSizes:      *sweepSizes,
+		Throttle:        *throttle,
+		ReferenceSpeed:  *referenceSpeed,
+
+		ServerName: *serverName,
+
+		TCPNoDelay:   *tcpNoDelay,
+		TCPKeepAlive: *tcpKeepAlive,
+		TCPInfo:      *tcpInfo,
+		Congestion:   *congestion,
+
+		HeaderBytes:   *headerBytes,
+		FrameOverhead: *frameOverhead,
+
+		DialTimeout:  *dialTimeout,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+
+		MaxUpload:    *maxUpload,
+		DownloadGzip: *downloadGzip,
+		DebugReads:   *debugReads,
+
+		AdminToken: *adminToken,
+		Token:      *apiToken,
+
+		MeasureJitter: *measureJitter,
+		ReadBuffer:    *readBuffer,
+
+		Peers:            *aggregatePeers,
+		AggregateWorkers: *aggregateWorkers,
+		PeerTimeout:      *peerTimeout,
+
+		ResultsFile: *resultFile,
+		TraceFile:   *traceFile,
+	}
+	if cfg.ServerName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("Hostname error: %v", err)
+		}
+		cfg.ServerName = hostname
+	}
+	return cfg
+}
+
+// validate reports the first setting that can't be used
+func (c *Config) validate() error {
+	if c.ChunkSize <= 0 {
+		return errors.New("-chunk-size must be positive")
+	}
+	if err := fillBuffer(nil, c.DataMode); err != nil {
+		return fmt.Errorf("invalid -data-mode: %w", err)
+	}
+	if err := checkServeFile(c.ServeFile); err != nil {
+		return fmt.Errorf("invalid -serve-file: %w", err)
+	}
+	if c.ZeroCopy && c.ServeFile == "" {
+		return errors.New("-zerocopy requires -serve-file")
+	}
+	if err := validateMetric(c.FinalMetric); err != nil {
+		return fmt.Errorf("invalid -final-metric: %w", err)
+	}
+	if c.MaxMessageSize <= 0 {
+		return errors.New("-max-message-size must be positive")
+	}
+	if c.HeaderBytes < 0 || c.HeaderBytes >= ethernetMtu || c.FrameOverhead < 0 {
+		return errors.New("-header-bytes and -frame-overhead must not be negative, and headers must fit an Ethernet MTU")
+	}
+	if _, err := parseChunkSizes(c.SweepSizes); err != nil {
+		return fmt.Errorf("invalid -sweep: %w", err)
+	}
+	if c.ReadBuffer <= 0 {
+		return errors.New("-read-buffer must be positive")
+	}
+	if c.AggregateWorkers < 1 {
+		return errors.New("-aggregate-workers must be at least 1")
+	}
+	if c.ReferenceSpeed <= 0 {
+		return errors.New("-reference-speed must be positive")
+	}
+	if c.Throttle < 0 {
+		return errors.New("-throttle must not be negative")
+	}
+	if err := validateUnit(c.Unit); err != nil {
+		return fmt.Errorf("invalid -unit: %w", err)
+	}
+	return nil
+}
+
+// startupFlags only take effect when the process starts. Reloading -config
+// keeps their values.
+var startupFlags = []string{
+	"addr", "network", "addr-fallback-ephemeral", "config", "pprof", "ndjson", "output", "results-file", "summary-line",
+	"schedule", "schedule-target", "schedule-duration", "selftest", "min-expected",
+}
+
+// configSetting is one flag set by a -config file
+type configSetting struct {
+	line        int
+	name, value string
+}
+
+// readConfigFile reads a -config file, which lists flags one per line as
+// they would be given on the command line, e.g. "-token=secret" or
+// "-ndjson". Blank lines and lines starting with # are skipped.
+func readConfigFile(path string) ([]configSetting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var settings []configSetting
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimLeft(text, "-")
+		name, value, found := strings.Cut(text, "=")
+		if !found {
+			name, value, found = strings.Cut(text, " ")
+		}
+		if !found {
+			value = "true" // A bare boolean flag
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" {
+			return nil, fmt.Errorf("%s line %d: missing flag name", path, line)
+		}
+		settings = append(settings, configSetting{line: line, name: name, value: value})
+	}
+	return settings, scanner.Err()
+}
+
+// loadFlags resets every flag to its default, then sets the flags listed
+// in configPath and finally parses args, so the command line overrides the
+// file and flags removed from the file revert to their defaults
+func loadFlags(args []string, configPath string) error {
+	settings, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+	for _, setting := range settings {
+		if err := flag.Set(setting.name, setting.value); err != nil {
+			return fmt.Errorf("%s line %d: %w", configPath, setting.line, err)
+		}
+	}
+	return flag.CommandLine.Parse(args)
+}
+
+// reloadConfig loads the flags again as loadFlags does and returns the
+// resulting Config. Changes to startupFlags are logged and ignored. If the
+// file or the Config is invalid, the flags keep their previous values.
+func reloadConfig(args []string, configPath string) (*Config, error) {
+	saved := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		saved[f.Name] = f.Value.String()
+	})
+	restore := func() {
+		for name, value := range saved {
+			flag.Set(name, value)
+		}
+	}
+
+	if err := loadFlags(args, configPath); err != nil {
+		restore()
+		return nil, err
+	}
+	for _, name := range startupFlags {
+		if flag.Lookup(name).Value.String() != saved[name] {
+			log.Printf("Ignoring change to -%s, restart the server to apply it", name)
+			flag.Set(name, saved[name])
+		}
+	}
+	cfg := configFromFlags()
+	if err := cfg.validate(); err != nil {
+		restore()
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// reloadOnHangup replaces the Config of s with one reloaded from configPath
+// on every SIGHUP until ctx is cancelled. Tests already running finish with
+// the settings they started with.
+func reloadOnHangup(ctx context.Context, s *server, args []string, configPath string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+		cfg, err := reloadConfig(args, configPath)
+		if err != nil {
+			log.Printf("Reload error: %v", err)
+			continue
+		}
+		s.setConfig(cfg)
+		log.Printf("Reloaded %s", configPath)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// setCongestion selects the TCP congestion control algorithm of the socket c
+func setCongestion(c syscall.RawConn, algorithm string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, algorithm)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setCongestion is not supported on this platform
+func setCongestion(c syscall.RawConn, algorithm string) error {
+	return errors.ErrUnsupported
+}
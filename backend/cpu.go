@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A process using at least this many cores' worth of CPU is considered
+// pegged. The test loop runs on a single goroutine, so one busy core is
+// enough to cap throughput.
+const cpuBoundThreshold = 0.9
+
+// cpuMonitor samples process CPU utilization once a second during a test
+type cpuMonitor struct {
+	mu     sync.Mutex
+	busy   int
+	sample int
+}
+
+// monitorCPU samples CPU utilization until ctx is done
+func monitorCPU(ctx context.Context) *cpuMonitor {
+	m := &cpuMonitor{}
+	last, ok := processCPUTime()
+	if !ok {
+		return m
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lastWall := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				cpu, ok := processCPUTime()
+				if !ok {
+					return
+				}
+				utilization := (cpu - last).Seconds() / now.Sub(lastWall).Seconds()
+				last, lastWall = cpu, now
+
+				m.mu.Lock()
+				m.sample++
+				if utilization >= cpuBoundThreshold {
+					m.busy++
+				}
+				m.mu.Unlock()
+			}
+		}
+	}()
+	return m
+}
+
+// cpuBound reports whether the CPU was pegged for at least half of the samples
+func (m *cpuMonitor) cpuBound() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sample > 0 && m.busy*2 >= m.sample
+}
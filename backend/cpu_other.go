@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "time"
+
+// processCPUTime is not supported on this platform
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+)
+
+// readSizeRecorder wraps a reader and counts how many bytes each Read
+// returned, in power-of-two buckets. Reads far smaller than the buffer
+// offered point at socket buffers being the bottleneck.
+type readSizeRecorder struct {
+	r       io.Reader
+	buckets [65]int // Bucket i counts reads of [2^(i-1), 2^i) bytes, bucket 0 empty reads
+}
+
+func (rr *readSizeRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buckets[bits.Len(uint(n))]++
+	return n, err
+}
+
+// String formats the non-empty buckets, e.g. "[16384,32768):12"
+func (rr *readSizeRecorder) String() string {
+	var parts []string
+	for i, count := range rr.buckets {
+		if count == 0 {
+			continue
+		}
+		if i == 0 {
+			parts = append(parts, fmt.Sprintf("0:%d", count))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("[%d,%d):%d", uint64(1)<<(i-1), uint64(1)<<i, count))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+// Thresholds for diagnose. Round trip times on a healthy LAN stay within a
+// few milliseconds under load and TCP rarely needs to resend anything.
+const (
+	diagnosisBloatMs        = 50   // Latency under load above idle that counts as a spike
+	diagnosisRetransmitRate = 0.01 // Fraction of segments resent that counts as heavy loss
+)
+
+// diagnose returns a hint for a helpdesk about what a test's results point
+// at, or nothing if they look healthy. A duplex mismatch shows up as
+// latency spiking under load together with heavy retransmission, as the
+// half-duplex end drops frames it sees as collisions. Either symptom alone
+// gets a weaker hint. Retransmits are only known with -tcp-info, and bytes
+// is the test data the retransmits are weighed against.
+func diagnose(final SpeedTestMessage, bytes int64) string {
+	spiking := final.BufferbloatMs > diagnosisBloatMs
+	var retransmitRate float64
+	if final.TCPInfo != nil && final.Mss > 0 && bytes > 0 {
+		segments := float64(bytes) / float64(final.Mss)
+		retransmitRate = float64(final.TCPInfo.Retransmits) / segments
+	}
+	lossy := retransmitRate > diagnosisRetransmitRate
+
+	switch {
+	case spiking && lossy:
+		return fmt.Sprintf("possible duplex mismatch: latency rises %.0f ms under load and %.1f%% of segments were resent, check both ends negotiate the same speed and duplex",
+			final.BufferbloatMs, retransmitRate*100)
+	case spiking:
+		return fmt.Sprintf("latency rises %.0f ms under load, which points at bufferbloat or a duplex mismatch",
+			final.BufferbloatMs)
+	case lossy:
+		return fmt.Sprintf("%.1f%% of segments were resent, check cabling and duplex settings", retransmitRate*100)
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// loopingFile reads a file, starting over from the beginning whenever it
+// reaches the end, so a small file can serve any amount of test data
+type loopingFile struct {
+	f *os.File
+}
+
+// openServeFile opens ServeFile, or returns nil if it isn't set
+func (c *Config) openServeFile() (*loopingFile, error) {
+	if c.ServeFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(c.ServeFile)
+	if err != nil {
+		return nil, err
+	}
+	return &loopingFile{f: f}, nil
+}
+
+// checkServeFile verifies that path, if set, is a non-empty regular file
+func checkServeFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return fmt.Errorf("%s is not a non-empty regular file", path)
+	}
+	return nil
+}
+
+func (lf *loopingFile) Read(p []byte) (int, error) {
+	n, err := lf.f.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	if _, err := lf.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err = lf.f.Read(p)
+	if n == 0 && err == io.EOF {
+		return 0, errors.New("serve file is empty")
+	}
+	return n, err
+}
+
+// copyTo copies total bytes of the file, looping as needed, to w. Each pass
+// reads the *os.File directly, so when w is a TCP connection, such as an
+// uncompressed HTTP response, the runtime can send it with sendfile
+// instead of copying it through user space.
+func (lf *loopingFile) copyTo(w io.Writer, total int64) (int64, error) {
+	var written int64
+	for written < total {
+		n, err := io.Copy(w, &io.LimitedReader{R: lf.f, N: total - written})
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if written < total {
+			if n == 0 {
+				return written, errors.New("serve file is empty")
+			}
+			if _, err := lf.f.Seek(0, io.SeekStart); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close closes the file. It is safe to call on a nil loopingFile.
+func (lf *loopingFile) Close() error {
+	if lf == nil {
+		return nil
+	}
+	return lf.f.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// historyColumns is the header row of /api/history.csv
+var historyColumns = []string{"time", "client", "direction", "average", "min", "max", "unit", "latency_ms", "target"}
+
+// maxHistoryLine is the longest results file line read back, far more than
+// any record takes
+const maxHistoryLine = 1024 * 1024 // bytes
+
+// historyClient is the client column of scheduled tests, which this server
+// runs against another one
+const historyClient = "local"
+
+// handleHistoryCSV streams the results in ResultsFile as a CSV download,
+// one row per result, without loading the whole file
+func (s *server) handleHistoryCSV(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if cfg.ResultsFile == "" {
+		writeJSONError(w, r, http.StatusNotFound, "history_disabled", "no -results-file is configured")
+		return
+	}
+	f, err := os.Open(cfg.ResultsFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Opening results file: %v", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "history_unavailable", "failed to open results file")
+		return
+	}
+	if f != nil {
+		defer f.Close()
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="speedtest-history.csv"`)
+	out := csv.NewWriter(w)
+	defer out.Flush()
+	if err := out.Write(historyColumns); err != nil {
+		log.Printf("Write error: %v", err)
+		return
+	}
+	if f == nil {
+		return // No test has finished yet
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxHistoryLine)
+	for scanner.Scan() {
+		var rec ResultRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // A line still being written
+		}
+		client := rec.Client
+		if rec.Mode == "scheduled" {
+			client = historyClient
+		}
+		row := []string{
+			rec.Time.Format(time.RFC3339),
+			client,
+			// Records from before directions were logged are all downloads
+			cmp.Or(rec.Direction, "download"),
+			formatFloat(rec.Average),
+			formatFloat(rec.Min),
+			formatFloat(rec.Max),
+			rec.Unit,
+			formatFloat(rec.LatencyMs),
+			rec.Target,
+		}
+		if err := out.Write(row); err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// The status has been sent, so the download is cut off instead, rather
+		// than passing off the rows so far as the whole history
+		log.Printf("Reading results file: %v", err)
+		out.Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// formatFloat formats a CSV number with enough precision for charting
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeResults writes recs to a results file the way resultLog does
+func writeResults(t *testing.T, recs ...ResultRecord) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "results.ndjson")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestHistoryCSV(t *testing.T) {
+	now := time.Now()
+	cfg := testConfig()
+	cfg.ResultsFile = writeResults(t,
+		newResultRecord("192.0.2.7:50000", "timed", time.Second, SpeedTestMessage{Average: 900, Unit: unitMbps}),
+		ResultRecord{Time: now, Target: "peer:8080", Mode: "scheduled", Direction: "download", SpeedTestMessage: SpeedTestMessage{Average: 800, Unit: unitMbps}},
+		// Longer than bufio.Scanner's default limit
+		ResultRecord{Time: now, Client: "192.0.2.8", Mode: "timed", SpeedTestMessage: SpeedTestMessage{Message: strings.Repeat("x", 100*1024)}},
+	)
+	addr := startServer(t, cfg)
+
+	resp, err := http.Get("http://" + addr + "/api/history.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("got %d rows, want a header and 3 records: %q", len(rows), rows)
+	}
+	// client, direction and target of each record
+	want := [][3]string{{"192.0.2.7", "download", ""}, {historyClient, "download", "peer:8080"}, {"192.0.2.8", "download", ""}}
+	for i, row := range rows[1:] {
+		if got := [3]string{row[1], row[2], row[8]}; got != want[i] {
+			t.Errorf("row %d has client, direction and target %q, want %q", i+1, got, want[i])
+		}
+	}
+}
+
+func TestHistoryCSVAbortsOnUnreadableLine(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResultsFile = writeResults(t, ResultRecord{Mode: "timed", SpeedTestMessage: SpeedTestMessage{Message: strings.Repeat("x", maxHistoryLine)}})
+	addr := startServer(t, cfg)
+
+	// Depending on how much was sent before, the request or the body fails
+	resp, err := http.Get("http://" + addr + "/api/history.csv")
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+	}
+	if err == nil {
+		t.Error("history read past an unreadable line ended like a complete download")
+	}
+}
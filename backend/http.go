@@ -0,0 +1,267 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Process-wide counters, updated atomically on the hot path
+var (
+	startedAt         = time.Now()
+	connectionsServed atomic.Int64 // WebSocket sessions, downloads and uploads
+	bytesServed       atomic.Int64 // Test data sent
+)
+
+// ServerStats is the response to /stats
+type ServerStats struct {
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	ConnectionsServed int64   `json:"connectionsServed"`
+	BytesServed       int64   `json:"bytesServed"`
+}
+
+// APIError is the body of every failed HTTP API response
+type APIError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"` // Short machine-readable error code
+	Path  string `json:"path"`
+}
+
+// writeJSONError responds with status and an APIError body
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(APIError{Error: msg, Code: code, Path: r.URL.Path}); err != nil {
+		log.Printf("Write error: %v", err)
+	}
+}
+
+// UploadResult is the response to a successful /upload
+type UploadResult struct {
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"` // Seconds
+	Speed    float64 `json:"speed"`    // Speed in unit
+	Unit     string  `json:"unit"`     // See -unit
+}
+
+// writeJSON responds with v encoded as JSON
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Write error: %v", err)
+	}
+}
+
+// allowCORS lets the frontend, which is served from another port, call handler
+func allowCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// hasBearerToken reports whether r carries token in its Authorization header
+func hasBearerToken(r *http.Request, token string) bool {
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// requireToken rejects requests to handler that don't carry the server's
+// bearer token. Where allowQuery is set, it may be passed as the token
+// query parameter instead, since browsers can't set headers on a WebSocket
+// or EventSource, nor on a plain link to a download.
+func (s *server) requireToken(handler http.HandlerFunc, allowQuery bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := s.config().Token
+		if token != "" && !hasBearerToken(r, token) &&
+			!(allowQuery && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) == 1) {
+			writeJSONError(w, r, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleDownload streams the requested number of bytes of test data so a
+// download can be measured over plain HTTP when only the web port is reachable
+func (s *server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	connectionsServed.Add(1)
+	total, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+	if err != nil || total < 0 {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_bytes", "invalid bytes parameter")
+		return
+	}
+	total = clampSize("download payload", total, cfg.MaxPayload)
+
+	file, err := cfg.openServeFile()
+	if err != nil {
+		log.Printf("Opening serve file: %v", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "serve_file", "failed to open serve file")
+		return
+	}
+	defer file.Close()
+
+	// Keep proxies from caching or compressing the response, either of
+	// which would inflate the measured speed, unless gzip is explicitly allowed
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store, no-transform")
+	var body io.Writer = w
+	if cfg.DownloadGzip && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		defer gz.Close()
+		body = gz
+	} else {
+		w.Header().Set("Content-Encoding", "identity")
+		w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+	}
+
+	rc := http.NewResponseController(w)
+	// The deadline would otherwise outlive the response on a kept-alive connection
+	defer rc.SetWriteDeadline(time.Time{})
+	limiter := newRateLimiter(cfg.Throttle)
+	data := body
+	if !cfg.ZeroCopy || limiter != nil {
+		// Zero-copy hands the file to sendfile, which wrapping the body
+		// would prevent, so unthrottled its deadline is only set per chunk
+		data = &deadlineWriter{w: body, setDeadline: rc.SetWriteDeadline, timeout: cfg.WriteTimeout}
+	}
+	data = limiter.writer(data)
+	for remaining := total; remaining > 0; {
+		n := min(remaining, cfg.ChunkSize)
+		if err := rc.SetWriteDeadline(deadline(cfg.WriteTimeout)); err != nil {
+			log.Printf("Download write error: %v", err)
+			return
+		}
+		if err := cfg.writeTestData(data, file, n); err != nil {
+			log.Printf("Download write error: %v", err)
+			return
+		}
+		remaining -= n
+		// Flush after every chunk so intermediaries don't buffer the whole response
+		if gz, ok := body.(*gzip.Writer); ok {
+			if err := gz.Flush(); err != nil {
+				log.Printf("Download write error: %v", err)
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			log.Printf("Download write error: %v", err)
+			return
+		}
+	}
+}
+
+// deadlineReader renews a read deadline of timeout before every read, so a
+// stalled upload fails without limiting how long a large one may take
+type deadlineReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if err := d.rc.SetReadDeadline(deadline(d.timeout)); err != nil {
+		return 0, err
+	}
+	return d.r.Read(p)
+}
+
+// handleUpload reads and discards the request body, responding with the
+// measured upload speed so browsers can test uploads with fetch
+func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	connectionsServed.Add(1)
+	start := time.Now()
+	rc := http.NewResponseController(w)
+	defer rc.SetReadDeadline(time.Time{})
+	var body io.Reader = &deadlineReader{r: http.MaxBytesReader(w, r.Body, cfg.MaxUpload), rc: rc, timeout: cfg.ReadTimeout}
+	body = newRateLimiter(cfg.Throttle).reader(body)
+	if cfg.DebugReads {
+		recorder := &readSizeRecorder{r: body}
+		defer func() { log.Printf("Upload read sizes: %s", recorder) }()
+		body = recorder
+	}
+	n, err := io.Copy(io.Discard, body)
+	duration := time.Since(start)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, r, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("upload exceeds %d bytes", maxBytesErr.Limit))
+			return
+		}
+		log.Printf("Upload read error: %v", err)
+		writeJSONError(w, r, http.StatusBadRequest, "read_failed", "failed to read upload")
+		return
+	}
+
+	writeJSON(w, UploadResult{
+		Bytes:    n,
+		Duration: duration.Seconds(),
+		Speed:    cfg.toUnit(cfg.plausibleSpeed(measureSpeed(n, duration))),
+		Unit:     cfg.Unit,
+	})
+}
+
+// handleStopAll stops every running test and reports how many were stopped
+func (s *server) handleStopAll(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	if cfg.AdminToken == "" {
+		writeJSONError(w, r, http.StatusNotFound, "admin_disabled", "admin endpoints are disabled")
+		return
+	}
+	if !hasBearerToken(r, cfg.AdminToken) {
+		writeJSONError(w, r, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	stopped := activeTests.stopAll()
+	log.Printf("Stopped %d active tests", stopped)
+	writeJSON(w, map[string]int{"stopped": stopped})
+}
+
+// handleHealthz reports that the server is up and which server it is
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	writeJSON(w, map[string]string{"status": "ok", "server": cfg.ServerName})
+}
+
+// handleStats reports process uptime and totals for capacity planning
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, ServerStats{
+		UptimeSeconds:     time.Since(startedAt).Seconds(),
+		ConnectionsServed: connectionsServed.Load(),
+		BytesServed:       bytesServed.Load(),
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	idleLatencyProbes = 5
+	loadedProbeGap    = 200 * time.Millisecond
+	pingTimeout       = 2 * time.Second
+)
+
+var errPingTimeout = errors.New("ping timed out")
+
+// handlePong delivers the round trip time of a ping sent by ping. Pongs
+// are only read while the connection's read loop is running.
+func (c *wsConn) handlePong(data string) error {
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return nil // Not one of our pings
+	}
+	select {
+	case c.pongs <- time.Since(time.Unix(0, sent)):
+	default:
+	}
+	return nil
+}
+
+// ping measures one WebSocket round trip using a ping control frame. Control
+// frames are interleaved with the fragments of a test message, so under
+// load the round trip includes time spent queued behind test data.
+func (c *wsConn) ping(ctx context.Context) (time.Duration, error) {
+	// Discard a late pong from an earlier timed out ping
+	select {
+	case <-c.pongs:
+	default:
+	}
+
+	payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := c.WriteControl(websocket.PingMessage, payload, time.Now().Add(pingTimeout)); err != nil {
+		return 0, err
+	}
+	select {
+	case rtt := <-c.pongs:
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(pingTimeout):
+		return 0, errPingTimeout
+	}
+}
+
+// measureIdleLatency returns the average of a few round trips on an idle
+// connection. The test waits for it, so probing stops at the first failure
+// rather than keeping a client that doesn't answer pings waiting for each.
+func measureIdleLatency(ctx context.Context, conn *wsConn) (time.Duration, bool) {
+	var total time.Duration
+	var n int
+	for range idleLatencyProbes {
+		rtt, err := conn.ping(ctx)
+		if err != nil {
+			break
+		}
+		total += rtt
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return total / time.Duration(n), true
+}
+
+// measureLoadedLatency pings repeatedly until ctx is done, then sends the
+// average round trip, or zero if no ping was answered
+func measureLoadedLatency(ctx context.Context, conn *wsConn) <-chan time.Duration {
+	result := make(chan time.Duration, 1)
+	go func() {
+		var total time.Duration
+		var n int
+		for ctx.Err() == nil {
+			if rtt, err := conn.ping(ctx); err == nil {
+				total += rtt
+				n++
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(loadedProbeGap):
+			}
+		}
+		if n == 0 {
+			result <- 0
+			return
+		}
+		result <- total / time.Duration(n)
+	}()
+	return result
+}
+
+// durationMs converts d to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
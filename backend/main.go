@@ -4,53 +4,459 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"runtime/trace"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
+// Command line flags. Server settings are only read by configFromFlags,
+// the rest is used by main itself.
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-
-	// Configuration
-	serverAddr = flag.String("addr", ":8080", "WebSocket server address")
+	serverAddr = flag.String("addr", ":8080", "WebSocket server address (a socket path with -network unix)")
+	network    = flag.String("network", "tcp", "Network to listen on: tcp, or unix for same-host tests that bypass the NIC")
 	chunkSize  = flag.Int("chunk-size", 8*1024*1024, "Size of test data chunks in bytes")
+	dataMode   = flag.String("data-mode", dataModeRandom, "Test data content: random, zero or counter")
+	serveFile  = flag.String("serve-file", "", "Send the contents of this file, looped as needed, instead of generated data")
+	zeroCopy   = flag.Bool("zerocopy", false, "Let the kernel send -serve-file straight to the socket (sendfile) where possible")
+
+	// Repeating a block lets compressing middleboxes or NICs inflate results.
+	// Recycling costs CPU while sending but keeps random data unrepeated.
+	recycleRandom = flag.Duration("recycle-random", 0, "Regenerate part of the repeated random data block at this interval while sending (0 disables)")
+
+	// Limits on sizes clients may request
+	maxChunkSize = flag.Int64("max-chunk-size", 64*1024*1024, "Maximum chunk size in bytes a client may request (0 is unlimited)")
+	maxPayload   = flag.Int64("max-payload", 10*1024*1024*1024, "Maximum bytes a client may request from /download (0 is unlimited)")
+
+	// Compression only ever applies to the JSON control messages. Test data
+	// is sent uncompressed so zero or patterned data can't inflate results.
+	wsCompress    = flag.Bool("ws-compress", false, "Negotiate permessage-deflate for WebSocket control messages")
+	wsReadBuffer  = flag.Int("ws-read-buffer", 1024, "WebSocket read buffer size in bytes")
+	wsWriteBuffer = flag.Int("ws-write-buffer", 1024, "WebSocket write buffer size in bytes")
+
+	// Clients only ever send small JSON control messages
+	maxMessageSize = flag.Int64("max-message-size", 4096, "Largest WebSocket message in bytes accepted from a client, larger ones close the connection")
+
+	// Very short tests mostly measure TCP slow start
+	minDuration = flag.Int("min-duration", 3, "Minimum test duration in seconds")
+	maxDuration = flag.Int("max-duration", 600, "Maximum test duration in seconds, not applied to continuous tests (0 is unlimited)")
+
+	// A warmup ramps up TCP windows on the test's connection before anything
+	// is measured, instead of letting slow start drag down the first samples
+	warmup = flag.Int("warmup", 0, "Default seconds of unmeasured test data sent before each test")
+
+	// Idle gaps between chunks can make TCP restart slow start on every
+	// chunk, so streamed tests send chunks back to back instead
+	stream = flag.Bool("stream", false, "Send test data as a continuous stream rather than one chunk per sample interval, unless a start message says otherwise")
+
+	// Bounds memory in long and continuous tests. Mean, min and max still
+	// cover every sample, but median, trimmed and p95 only the retained ones.
+	maxSamples = flag.Int("max-samples", 10000, "Number of most recent samples retained per test")
+
+	maxPlausible = flag.Float64("max-plausible", 400000, "Ceiling in Mbps above which samples are clamped as timing artifacts (0 disables)")
+	finalMetric  = flag.String("final-metric", metricMean, "Statistic reported as the final average: mean, weighted, median, trimmed or p95")
+	speedUnit    = flag.String("unit", unitMbps, "Unit of reported speeds: mbps, gbps or mbyteps")
+
+	maxSessionBytes = flag.Int64("max-session-bytes", 0, "Maximum bytes of test data one WebSocket session may transfer (0 is unlimited)")
+
+	// Chunk sizes a sweep compares, from small messages to the default
+	sweepSizes = flag.String("sweep", "65536,262144,1048576,8388608", "Comma-separated chunk sizes in bytes tested by a start message with sweep")
+
+	// Tests sharing the server's NIC skew each other's results
+	maxActiveTests = flag.Int("max-active-tests", 0, "Maximum number of tests running at once across all clients, further starts are refused (0 is unlimited)")
+
+	// Simulates a slower link, e.g. to check how a client presents one
+	throttle = flag.Float64("throttle", 0, "Limit test data on each connection to this many Mbps (0 is unlimited)")
+
+	// The speed a link should reach to be scored as fast, e.g. its nominal speed
+	referenceSpeed = flag.Float64("reference-speed", 1000, "Speed in Mbps that earns a full score for throughput")
+
+	serverName = flag.String("name", "", "Server name reported to clients (defaults to the hostname)")
+
+	// TCP tuning for test connections. No-delay keeps the small JSON speed
+	// updates from being held back by Nagle's algorithm behind bulk data;
+	// turning it off can shave a little overhead on slow CPUs. Keepalive lets
+	// back-to-back or long tests notice a dead peer instead of hanging.
+	tcpNoDelay   = flag.Bool("tcp-nodelay", true, "Disable Nagle's algorithm on test connections")
+	tcpKeepAlive = flag.Duration("tcp-keepalive", 0, "TCP keepalive period for test connections, accepted or dialed (0 keeps the default, negative disables)")
+	tcpInfo      = flag.Bool("tcp-info", false, "Report the kernel's RTT, retransmits and congestion window for each test (Linux only)")
+	congestion   = flag.String("congestion", "", "TCP congestion control algorithm for test connections, e.g. bbr or cubic (Linux only)")
+
+	// Per-packet overhead for estimating throughput on the wire. The defaults
+	// are IPv4 and TCP headers with timestamps, and Ethernet's header, FCS,
+	// preamble and inter-frame gap. Use 72 header bytes for IPv6.
+	headerBytes   = flag.Int("header-bytes", 52, "TCP/IP header bytes per segment assumed by estimatedWireMbps")
+	frameOverhead = flag.Int("frame-overhead", 38, "Link layer bytes per frame assumed by estimatedWireMbps")
+
+	// Connection timeouts. Raise them for very slow or distant links, lower
+	// them on a fast LAN to fail fast. Read and write timeouts apply to each
+	// read or write, not to a whole test.
+	dialTimeout  = flag.Duration("dial-timeout", 5*time.Second, "Time limit for connecting to a server in -selftest and /api/aggregate")
+	readTimeout  = flag.Duration("read-timeout", 10*time.Second, "Time limit for reading request headers and each read of an /upload body")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "Time limit for writing each message or block of test data, so a stalled client is caught however long a whole chunk takes")
+
+	// HTTP test endpoints
+	maxUpload    = flag.Int64("max-upload", 1024*1024*1024, "Maximum size in bytes of an /upload request body")
+	downloadGzip = flag.Bool("download-gzip", false, "Gzip /download responses for clients that accept it, to measure the compressed case")
+	debugReads   = flag.Bool("debug-reads", false, "Log the distribution of read sizes for each /upload")
+
+	// Timing every read costs a little CPU on fast links
+	measureJitter = flag.Bool("measure-jitter", false, "Report the jitter of data arrival in tests run as a client by -selftest, -schedule and /api/aggregate")
+
+	// Reads far smaller than a chunk keep up just as well and save memory per stream
+	readBuffer = flag.Int("read-buffer", defaultReadBuffer, "Bytes read at a time from test data in tests run as a client by -selftest, -schedule and /api/aggregate")
+
+	// Profiling, to line up throughput drops with GC pauses and other
+	// runtime events. Both are off by default and cost performance when on.
+	pprofAddr = flag.String("pprof", "", "Serve net/http/pprof on this separate address, e.g. localhost:6060 (unset disables)")
+	traceFile = flag.String("trace", "", "Write a runtime execution trace of each test, with its speed samples, to this file (unset disables)")
+
+	// Admin endpoints are disabled unless a token is set
+	adminToken = flag.String("admin-token", "", "Bearer token required by /admin endpoints")
+
+	// Access control for servers reachable beyond the local network
+	apiToken = flag.String("token", "", "Bearer token required by /ws, /events, /download, /upload and /api endpoints (unset leaves them open)")
+
+	// Aggregate tests against peer servers
+	aggregatePeers   = flag.String("peers", "", "Comma-separated host:port list of peer servers for /api/aggregate, and the only ones sweep targets may name")
+	aggregateWorkers = flag.Int("aggregate-workers", 4, "Maximum number of peers /api/aggregate tests at once")
+	peerTimeout      = flag.Duration("peer-timeout", 30*time.Second, "Time limit for testing one peer in /api/aggregate")
+
+	// Result logging
+	ndjson     = flag.Bool("ndjson", false, "Write each final result as a line of JSON")
+	ndjsonPath = flag.String("output", "", "File to append -ndjson results to (defaults to stdout)")
+	resultFile = flag.String("results-file", "", "File to append each final result to as a line of JSON")
+
+	// Log output goes to stderr, so stdout carries nothing but these lines
+	summaryLines = flag.Bool("summary-line", false, "Print one key=value summary line per completed test to stdout for log scrapers")
+
+	// Scheduled tests make the server a passive monitor of another server
+	scheduleInterval = flag.Duration("schedule", 0, "Test -schedule-target at this interval, recording results like on-demand tests (0 disables)")
+	scheduleTarget   = flag.String("schedule-target", "", "host:port of the server tested by -schedule")
+	scheduleDuration = flag.Int("schedule-duration", defaultDuration, "Duration in seconds of each scheduled test")
+
+	// Saves hunting for a free port on a busy development machine
+	addrFallback = flag.Bool("addr-fallback-ephemeral", false, "If the -addr port is taken, listen on an ephemeral port on the same host instead of exiting")
+
+	// Settings that can change without a restart, like -token, may be kept
+	// in a file and reloaded on SIGHUP. The command line overrides the file.
+	configPath = flag.String("config", "", "File of flags, one per line like -token=secret, read at startup and again on SIGHUP")
+
+	// Self-test
+	selfTest    = flag.Bool("selftest", false, "Run a loopback test against this server and exit")
+	minExpected = flag.Float64("min-expected", 1, "Minimum average speed in Mbps for -selftest to pass")
 )
 
+// Test data modes. zero is the cheapest to produce and fine for pure
+// throughput, counter (an incrementing byte sequence) allows integrity checks.
+const (
+	dataModeRandom  = "random"
+	dataModeZero    = "zero"
+	dataModeCounter = "counter"
+)
+
+const (
+	defaultDuration    = 10 // seconds
+	continuousDuration = -1 // Run until stopped, e.g. as a link monitor
+
+	selfTestDuration = 3  // seconds
+	maxWarmup        = 10 // seconds
+	peerTestDuration = 3  // seconds
+
+	selfTestDownloadBytes = 64 * 1024 * 1024
+
+	maxLabelLength = 64 // characters
+	maxIDLength    = 64 // characters
+
+	pausePollInterval = 100 * time.Millisecond
+	sampleInterval    = 500 * time.Millisecond // Between chunks, or between speed updates of streamed tests
+
+	blockSize       = 64 * 1024 // Test data is generated and written in blocks of this size
+	recycleFraction = 8         // -recycle-random regenerates this fraction (1/n) of the block at a time
+
+	minMeasurableDuration = time.Microsecond
+)
+
+// exitListenFailed is the exit status when the server can't bind its
+// address, e.g. because the port is taken, so deployment scripts can tell
+// it apart from other failures, which exit with 1
+const exitListenFailed = 2
+
+// exitReconnectsExhausted is the exit status of the client subcommand when
+// a test's connection kept failing after -reconnect-attempts reconnects
+const exitReconnectsExhausted = 3
+
+// protocolVersion is the version of the SpeedTestMessage protocol spoken by this server
+const protocolVersion = 1
+
+// SpeedTestMessage is exchanged as JSON over the WebSocket, and the server
+// messages are also streamed by /events. In version 1:
+//
+//	start   (client) id, duration, warmup, continuous, stream, burst,
+//	        binary, label, chunkSize, version: begin a test, or with
+//	        targets, test each of those -peers from this one in turn, or
+//	        with sweep, test each of the -sweep chunk sizes in turn
+//	stop    (client) end the running test or sweep early
+//	pause   (client) suspend sampling, answered with "paused"
+//	resume  (client) resume sampling, answered with "resumed"
+//	get_summary (client) request a "summary" of the tests run so far
+//	hello   (client) request the server's capabilities, answered with "hello"
+//	started (server) duration, durationMs, warmup, server, label: a test
+//	        has begun
+//	measuring (server) the warmup is over and measurement begins
+//	speed   (server) speed, unit, etaSeconds, elapsedMs: one sample, sent as a
+//	        binary message instead in binary tests, see encodeSample
+//	final   (server) average, min, max, peak, unit, duration, durationMs,
+//	        stopped, server, cpuBound, label, latencyMs, bufferbloatMs,
+//	        stdError, ciLow, ciHigh, tcpInfo, mss, estimatedWireMbps,
+//	        score, diagnosis: results
+//	summary (server) runs, average, min, max, unit: the mean, worst and
+//	        best headline averages of the session's finished tests
+//	hello   (server) capabilities: what the server supports, see Capabilities
+//	target  (server) target: the result of one target of a sweep
+//	sweep   (server) results, stopped: the results of every target tested
+//	chunk_result (server) chunkSize, average, unit: one test of a chunk
+//	        size sweep has finished
+//	chunk_sweep (server) chunkSweep, chunkSize, unit: the average of every
+//	        chunk size, fastest first, and the fastest chunk size
+//	notice  (server) message, duration, durationMs: the requested duration
+//	        was adjusted
+//	error   (server) error: a request failed or a test was aborted
+//
+// Every server message about a test carries the test's id, and every
+// server message carries version. A "start" naming another version
+// is rejected; clients that omit it are assumed to be compatible. A
+// continuous test only sends a final message once it is stopped.
 type SpeedTestMessage struct {
 	Type     string  `json:"type"`
-	Speed    float64 `json:"speed,omitempty"`    // Speed in Mbps
+	ID       string  `json:"id,omitempty"` // Identifies one test in logs and results, generated if a start omits it. Only letters, digits and "-_.:" are kept.
+	Version  int     `json:"version,omitempty"`
+	Speed    float64 `json:"speed,omitempty"` // Speed in unit
 	Average  float64 `json:"average,omitempty"`
-	Duration int     `json:"duration,omitempty"`
+	Unit     string  `json:"unit,omitempty"`     // Unit of every speed in the message, see -unit
+	Duration int     `json:"duration,omitempty"` // Seconds, kept alongside durationMs for older clients
+	Warmup   int     `json:"warmup,omitempty"`   // Seconds of unmeasured data sent before measuring, see -warmup
+	Min      float64 `json:"min,omitempty"`
+	Max      float64 `json:"max,omitempty"`
+	Stopped  bool    `json:"stopped,omitempty"`  // Final results of a test stopped early
+	Server   string  `json:"server,omitempty"`   // Name of the server running the test
+	CpuBound bool    `json:"cpuBound,omitempty"` // The server's CPU was saturated during the test
+	Error    string  `json:"error,omitempty"`
+	Message  string  `json:"message,omitempty"`
+	Label    string  `json:"label,omitempty"` // Client supplied label, e.g. a location
+
+	ChunkSize int64 `json:"chunkSize,omitempty"` // Bytes per test message, defaults to -chunk-size
+
+	EtaSeconds float64 `json:"etaSeconds,omitempty"` // Estimated time remaining in the test
+	ElapsedMs  int64   `json:"elapsedMs,omitempty"`  // Time measured so far, excluding pauses and warmup
+	DurationMs int64   `json:"durationMs,omitempty"` // Duration of the test in milliseconds
+	Continuous bool    `json:"continuous,omitempty"` // Run until stopped, same as a duration of -1
+
+	// Send chunks back to back, defaulting to -stream. A pointer so a start
+	// message can turn streaming off on a server started with -stream.
+	Stream *bool `json:"stream,omitempty"`
+
+	Burst bool `json:"burst,omitempty"` // Also measure the peak speed over short windows
+
+	Binary bool    `json:"binary,omitempty"` // Send samples as compact binary messages, WebSocket only
+	Peak   float64 `json:"peak,omitempty"`   // Highest speed over any burst window
+
+	Runs int `json:"runs,omitempty"` // Number of tests a summary covers
+
+	TCPInfo *TCPInfo `json:"tcpInfo,omitempty"` // Kernel statistics for the connection, with -tcp-info
+	Mss     int      `json:"mss,omitempty"`     // Maximum segment size of the connection, where the platform reports it
+
+	// Estimated rate on the wire including TCP/IP headers and link framing,
+	// always in Mbps, to compare the average with the link's line rate
+	EstimatedWireMbps float64 `json:"estimatedWireMbps,omitempty"`
+
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+
+	// Sweeps of other servers, WebSocket only
+	Targets []string     `json:"targets,omitempty"` // host:port of each server to test
+	Target  *PeerResult  `json:"target,omitempty"`
+	Results []PeerResult `json:"results,omitempty"`
+
+	// Chunk size sweeps, WebSocket only
+	Sweep      bool          `json:"sweep,omitempty"`
+	ChunkSweep []SweepResult `json:"chunkSweep,omitempty"`
+
+	LatencyMs     float64 `json:"latencyMs,omitempty"`     // Round trip time on the idle connection
+	BufferbloatMs float64 `json:"bufferbloatMs,omitempty"` // Increase in round trip time under load
+
+	// Precision of the mean sample speed, which is not necessarily the
+	// headline average. Runs whose intervals overlap may not really differ.
+	StdError float64 `json:"stdError,omitempty"` // Standard error of the mean
+	CILow    float64 `json:"ciLow,omitempty"`    // Lower bound of the 95% confidence interval
+	CIHigh   float64 `json:"ciHigh,omitempty"`   // Upper bound of the 95% confidence interval
+
+	Score     int    `json:"score,omitempty"`     // 0 to 100 summary of speed, latency and jitter, see computeScore
+	Diagnosis string `json:"diagnosis,omitempty"` // Hint at a likely problem such as a duplex mismatch, see diagnose
 }
 
 type SpeedTest struct {
 	mu        sync.Mutex
 	active    bool
-	speeds    []float64
+	paused    bool // Sampling is suspended but the test keeps its state
+	speeds    sampleRing
 	startTime time.Time
-	ctx       context.Context
-	cancel    context.CancelFunc
+
+	// Totals over all samples, so samples covering more time weigh more
+	totalBytes int64
+	totalTime  time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	cfg       *Config
+	session   *session
+	id        string     // Client supplied or generated ID echoed in every message of the test
+	label     string     // Client supplied label echoed in results
+	chunkSize int64      // Bytes of test data per message
+	warmup    int        // Seconds of unmeasured test data sent before measuring
+	stream    bool       // Chunks are sent back to back rather than once per sampleInterval
+	binary    bool       // Samples are sent as binary messages
+	peak      *peakMeter // Peak speed over short windows in burst tests, nil otherwise
+}
+
+// session is the state of one WebSocket connection, which may run many tests
+type session struct {
+	cfg     *Config
+	mu      sync.Mutex
+	bytes   int64      // Test data sent over the whole session
+	runs    sampleRing // Headline average in Mbps of each finished test
+	running bool       // A test is running, from its start until its final message is ready
+}
+
+// beginTest marks a test as running, reporting false if one already is
+func (s *session) beginTest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	return true
+}
+
+// endTest marks the running test as finished
+func (s *session) endTest() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+}
+
+// newSession returns the state for a new WebSocket connection
+func newSession(cfg *Config) *session {
+	return &session{cfg: cfg, runs: newSampleRing(cfg.MaxSamples)}
+}
+
+// addRun records the headline average in Mbps of a finished test
+func (s *session) addRun(average float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs.add(average)
+}
+
+// summary returns a "summary" message describing the tests finished so far
+func (s *session) summary() SpeedTestMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SpeedTestMessage{
+		Type:    "summary",
+		Runs:    s.runs.count,
+		Average: s.cfg.toUnit(s.runs.mean()),
+		Min:     s.cfg.toUnit(s.runs.min),
+		Max:     s.cfg.toUnit(s.runs.max),
+		Unit:    s.cfg.Unit,
+	}
+}
+
+// reserveBytes records n more bytes sent in the session, reporting false
+// without recording them if that would exceed MaxSessionBytes
+func (s *session) reserveBytes(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg.MaxSessionBytes > 0 && s.bytes+n > s.cfg.MaxSessionBytes {
+		return false
+	}
+	s.bytes += n
+	return true
+}
+
+// testRegistry tracks running tests so an operator can stop them all, and
+// limits how many may run at once
+type testRegistry struct {
+	mu    sync.Mutex
+	tests map[*SpeedTest]struct{}
+}
+
+var activeTests = &testRegistry{tests: make(map[*SpeedTest]struct{})}
+
+// tryAdd registers st, reporting false without registering it if limit
+// tests are already running. A limit of 0 is unlimited.
+func (tr *testRegistry) tryAdd(st *SpeedTest, limit int) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if limit > 0 && len(tr.tests) >= limit {
+		return false
+	}
+	tr.tests[st] = struct{}{}
+	return true
+}
+
+func (tr *testRegistry) remove(st *SpeedTest) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	delete(tr.tests, st)
 }
 
-func (st *SpeedTest) start() {
+// count returns the number of running tests
+func (tr *testRegistry) count() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.tests)
+}
+
+// stopAll stops every running test and returns how many there were
+func (tr *testRegistry) stopAll() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for st := range tr.tests {
+		st.stop()
+	}
+	return len(tr.tests)
+}
+
+// start starts the test with a context derived from parent, so the test is
+// stopped when parent is done as well as by stop
+func (st *SpeedTest) start(parent context.Context) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
 	st.active = true
-	st.speeds = make([]float64, 0)
+	st.speeds = newSampleRing(st.cfg.MaxSamples)
+	st.totalBytes = 0
+	st.totalTime = 0
 	st.startTime = time.Now()
-	st.ctx, st.cancel = context.WithCancel(context.Background())
+	st.ctx, st.cancel = context.WithCancel(parent)
 }
 
 func (st *SpeedTest) stop() {
@@ -62,109 +468,749 @@ func (st *SpeedTest) stop() {
 	st.active = false
 }
 
-func (st *SpeedTest) addSpeed(speed float64) {
+// setPaused pauses or resumes sampling, reporting whether that changed anything
+func (st *SpeedTest) setPaused(paused bool) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.active || st.paused == paused {
+		return false
+	}
+	st.paused = paused
+	return true
+}
+
+func (st *SpeedTest) isPaused() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.paused
+}
+
+// addSpeed records a sample of speed measured by sending bytes in elapsed time
+func (st *SpeedTest) addSpeed(speed float64, bytes int64, elapsed time.Duration) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
 	if st.active {
-		st.speeds = append(st.speeds, speed)
+		st.speeds.add(speed)
+		st.totalBytes += bytes
+		st.totalTime += elapsed
 	}
 }
 
 func (st *SpeedTest) getAverage() float64 {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	if len(st.speeds) == 0 {
-		return 0
+	return st.speeds.mean()
+}
+
+// getWeightedAverage returns the overall speed across all samples, total
+// bits over total seconds, rather than the mean of the sample speeds
+func (st *SpeedTest) getWeightedAverage() float64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return measureSpeed(st.totalBytes, st.totalTime)
+}
+
+// getHeadline returns the headline result according to FinalMetric
+func (st *SpeedTest) getHeadline() float64 {
+	switch st.cfg.FinalMetric {
+	case metricMean:
+		return st.getAverage()
+	case metricWeighted:
+		return st.getWeightedAverage()
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return summarize(st.speeds.values(), st.cfg.FinalMetric)
+}
+
+// getConfidence returns the standard error of the mean sample speed and
+// its 95% confidence interval
+func (st *SpeedTest) getConfidence() (stdError, low, high float64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	low, high = st.speeds.confidenceInterval()
+	return st.speeds.stdError(), low, high
+}
+
+// getTotalBytes returns the test data sent in all samples
+func (st *SpeedTest) getTotalBytes() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.totalBytes
+}
+
+func (st *SpeedTest) getMin() float64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.speeds.min
+}
+
+func (st *SpeedTest) getMax() float64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.speeds.max
+}
+
+// tuneTCPConn applies the configured TCP options to a test connection
+func (c *Config) tuneTCPConn(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(c.TCPNoDelay); err != nil {
+		log.Printf("SetNoDelay error: %v", err)
 	}
-	sum := 0.0
-	for _, speed := range st.speeds {
-		sum += speed
+	if c.TCPKeepAlive < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			log.Printf("SetKeepAlive error: %v", err)
+		}
+	} else if c.TCPKeepAlive > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			log.Printf("SetKeepAlive error: %v", err)
+		}
+		if err := tcpConn.SetKeepAlivePeriod(c.TCPKeepAlive); err != nil {
+			log.Printf("SetKeepAlivePeriod error: %v", err)
+		}
+	}
+	if c.Congestion != "" {
+		raw, err := tcpConn.SyscallConn()
+		if err == nil {
+			err = setCongestion(raw, c.Congestion)
+		}
+		warnCongestion(c.Congestion, err)
+	}
+}
+
+var congestionWarning sync.Once
+
+// warnCongestion logs, once, that algorithm could not be applied, which
+// happens on other platforms or when the algorithm's module isn't loaded
+func warnCongestion(algorithm string, err error) {
+	if err != nil {
+		congestionWarning.Do(func() {
+			log.Printf("Warning: ignoring -congestion %s: %v", algorithm, err)
+		})
+	}
+}
+
+// testDuration returns the duration in seconds to run a test for, applying
+// the default when unset and clamping it to MinDuration and MaxDuration. It
+// also reports whether a requested duration had to be clamped.
+func (c *Config) testDuration(requested int) (int, bool) {
+	switch {
+	case requested == continuousDuration:
+		return requested, false
+	case requested <= 0:
+		return defaultDuration, false
+	case requested < c.MinDuration:
+		return c.MinDuration, true
+	case c.MaxDuration > 0 && requested > c.MaxDuration:
+		return c.MaxDuration, true
+	}
+	return requested, false
+}
+
+// parseQueryDefaults reads test parameters from the WebSocket URL so test
+// presets can be bookmarked. A duration must be a positive number of
+// seconds, clamped like one in a start message. Only a start message can
+// ask for a continuous test, so a link can't get around -max-duration.
+func parseQueryDefaults(query url.Values) (SpeedTestMessage, error) {
+	var defaults SpeedTestMessage
+	if v := query.Get("duration"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d <= 0 {
+			return defaults, fmt.Errorf("invalid duration query parameter %q, want a positive number of seconds", v)
+		}
+		defaults.Duration = d
+	}
+	defaults.Label = query.Get("label")
+	return defaults, nil
+}
+
+// clampSize limits a client supplied size to limit, logging when it had to
+func clampSize(name string, requested, limit int64) int64 {
+	if limit > 0 && requested > limit {
+		log.Printf("Clamping requested %s of %d bytes to %d", name, requested, limit)
+		return limit
+	}
+	return requested
+}
+
+// newTestID returns a random version 4 UUID identifying a test
+func newTestID() string {
+	var b [16]byte
+	rand.Read(b[:]) // Never returns an error
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// sanitizeLabel strips unprintable characters such as line breaks from a
+// client supplied label, which ends up in logs and results, and truncates it
+// to maxLabelLength characters
+func sanitizeLabel(label string) string {
+	label = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if !unicode.IsGraphic(r) {
+			return -1
+		}
+		return r
+	}, label))
+	if utf8.RuneCountInString(label) <= maxLabelLength {
+		return label
+	}
+	return string([]rune(label)[:maxLabelLength])
+}
+
+// sanitizeID keeps only the ASCII letters, digits and "-_.:" of a client
+// supplied test ID, at most maxIDLength of them. That covers UUIDs and
+// other usual ID formats while keeping IDs safe to log.
+func sanitizeID(id string) string {
+	id = strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.:", r)) {
+			return r
+		}
+		return -1
+	}, id)
+	return id[:min(len(id), maxIDLength)]
+}
+
+// fillBuffer fills buf with test data according to mode
+func fillBuffer(buf []byte, mode string) error {
+	switch mode {
+	case dataModeRandom:
+		_, err := rand.Read(buf)
+		return err
+	case dataModeZero:
+		clear(buf)
+	case dataModeCounter:
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+	default:
+		return fmt.Errorf("unknown data mode %q", mode)
 	}
-	return sum / float64(len(st.speeds))
+	return nil
 }
 
-// generateTestData creates a buffer of random data for testing
-func generateTestData() []byte {
-	data := make([]byte, *chunkSize)
-	if _, err := rand.Read(data); err != nil {
-		log.Printf("Error generating test data: %v", err)
-		return nil
+// writeTestData writes total bytes of test data to w. Data is read from
+// file when it is not nil, otherwise one fixed-size generated block is
+// repeated, so memory stays flat however much is sent.
+func (c *Config) writeTestData(w io.Writer, file *loopingFile, total int64) error {
+	if file != nil && c.ZeroCopy {
+		n, err := file.copyTo(w, total)
+		bytesServed.Add(n)
+		return err
 	}
-	return data
+	if file != nil {
+		n, err := io.CopyBuffer(w, io.LimitReader(file, total), make([]byte, blockSize))
+		bytesServed.Add(n)
+		return err
+	}
+
+	block := make([]byte, min(total, blockSize))
+	if err := fillBuffer(block, c.DataMode); err != nil {
+		return err
+	}
+	recycle := c.RecycleRandom > 0 && c.DataMode == dataModeRandom
+	lastRecycle := time.Now()
+	recycleOffset := 0
+	for written := int64(0); written < total; {
+		if recycle && time.Since(lastRecycle) >= c.RecycleRandom {
+			// Regenerate the next slice of the block, cycling through all of it
+			part := block[recycleOffset:min(recycleOffset+len(block)/recycleFraction+1, len(block))]
+			if _, err := rand.Read(part); err != nil {
+				return err
+			}
+			recycleOffset = (recycleOffset + len(part)) % len(block)
+			lastRecycle = time.Now()
+		}
+		n := min(total-written, int64(len(block)))
+		if _, err := w.Write(block[:n]); err != nil {
+			return err
+		}
+		bytesServed.Add(n)
+		written += n
+	}
+	return nil
 }
 
-// measureSpeed calculates speed in Mbps
+// measureSpeed calculates speed in Mbps. Durations too short to time
+// meaningfully give 0 rather than an absurdly high speed.
 func measureSpeed(bytes int64, duration time.Duration) float64 {
 	bits := float64(bytes * 8)
-	seconds := duration.Seconds()
-	if seconds == 0 {
+	if duration < minMeasurableDuration {
 		return 0
 	}
-	return (bits / 1000000) / seconds // Convert to Mbps
+	return (bits / 1000000) / duration.Seconds() // Convert to Mbps
 }
 
-func runSpeedTest(conn *websocket.Conn, speedTest *SpeedTest, duration int) {
-	// Run tests for the specified duration
-	endTime := time.Now().Add(time.Duration(duration) * time.Second)
-	for time.Now().Before(endTime) && speedTest.active {
-		select {
-		case <-speedTest.ctx.Done():
-			return
-		default:
-			// Generate test data
-			testData := generateTestData()
-			if testData == nil {
+// plausibleSpeed clamps a measured speed to MaxPlausible, logging a
+// warning when it had to, since such a sample is a timing artifact
+func (c *Config) plausibleSpeed(speed float64) float64 {
+	if c.MaxPlausible > 0 && speed > c.MaxPlausible {
+		log.Printf("Warning: clamping implausible speed %.0f Mbps to %.0f Mbps", speed, c.MaxPlausible)
+		return c.MaxPlausible
+	}
+	return speed
+}
+
+// deadline returns the deadline for an operation limited to timeout, or no
+// deadline if timeout is zero or negative
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// deadlineWriter renews a write deadline of timeout before every write, so
+// the deadline catches a stalled peer without limiting how long a large
+// chunk may take on a slow but healthy link
+type deadlineWriter struct {
+	w           io.Writer
+	setDeadline func(time.Time) error
+	timeout     time.Duration
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if err := d.setDeadline(deadline(d.timeout)); err != nil {
+		return 0, err
+	}
+	return d.w.Write(p)
+}
+
+// wsConn serializes writes to a WebSocket, which allows only one writer at a time
+type wsConn struct {
+	*websocket.Conn
+	cfg     *Config
+	writeMu sync.Mutex
+	pongs   chan time.Duration // Round trip times of answered pings
+	limiter *rateLimiter       // Throttles test data, nil when unlimited
+}
+
+func (c *wsConn) remoteAddr() string {
+	return c.RemoteAddr().String()
+}
+
+// sendJSON sends msg stamped with the protocol version
+func (c *wsConn) sendJSON(msg SpeedTestMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	msg.Version = protocolVersion
+	if err := c.SetWriteDeadline(deadline(c.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	return c.WriteJSON(msg)
+}
+
+// sendBinary sends data as one binary message
+func (c *wsConn) sendBinary(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.SetWriteDeadline(deadline(c.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// writeTestMessage sends one chunk of test data as an uncompressed binary
+// message, measured by peak if it isn't nil. If the chunk fails part way,
+// the connection is closed, since finishing the message would hand the
+// client a short chunk that looks complete.
+func (c *wsConn) writeTestMessage(file *loopingFile, size int64, peak *peakMeter) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.EnableWriteCompression(false)
+	defer c.EnableWriteCompression(true)
+
+	if err := c.SetWriteDeadline(deadline(c.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	w, err := c.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	dst := c.limiter.writer(&deadlineWriter{w: w, setDeadline: c.SetWriteDeadline, timeout: c.cfg.WriteTimeout})
+	if peak != nil {
+		dst = peak.wrap(dst)
+	}
+	if err := c.cfg.writeTestData(dst, file, size); err != nil {
+		// A close frame may interrupt a message, so the client still learns why
+		closing := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to send test data")
+		c.WriteControl(websocket.CloseMessage, closing, deadline(c.cfg.WriteTimeout))
+		c.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// testSink is where a running test sends its messages and test data
+type testSink interface {
+	sendJSON(msg SpeedTestMessage) error
+	writeTestMessage(file *loopingFile, size int64, peak *peakMeter) error
+	remoteAddr() string
+}
+
+// abortTest tells the client that the test id ended early because of reason,
+// so it isn't left waiting for a final message that will never come
+func abortTest(conn testSink, id, reason string) {
+	if err := conn.sendJSON(SpeedTestMessage{Type: "error", ID: id, Error: reason}); err != nil {
+		log.Printf("Write error: %v", err)
+	}
+}
+
+// recoverTest stops a panic in the test id from crashing the server, which
+// would end every other client's tests too. It logs the panic with its
+// stack and closes the test's WebSocket, ending only that session. Handler
+// goroutines are already recovered by net/http, but tests run in their own.
+func recoverTest(conn testSink, id string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	log.Printf("Test %s panicked: %v\n%s", id, v, debug.Stack())
+	abortTest(conn, id, "internal server error")
+	if ws, ok := conn.(*wsConn); ok {
+		ws.Close()
+	}
+}
+
+// runSpeedTest runs speedTest to the end and returns its final message, or
+// completed false if the test was aborted or the final message couldn't be sent
+func runSpeedTest(conn testSink, speedTest *SpeedTest, duration int) (final SpeedTestMessage, completed bool) {
+	defer recoverTest(conn, speedTest.id)
+	ctx := speedTest.ctx
+	cfg := speedTest.cfg
+	// The session, and under -max-active-tests any client, may start
+	// another test once this one has its final results, or once it has
+	// ended early
+	var endOnce sync.Once
+	endTest := func() {
+		endOnce.Do(func() {
+			activeTests.remove(speedTest)
+			speedTest.session.endTest()
+		})
+	}
+	defer endTest()
+	defer speedTest.stop() // Release the context however the test ends
+	defer startTrace(cfg.TraceFile, speedTest.id)()
+
+	file, err := cfg.openServeFile()
+	if err != nil {
+		log.Printf("Opening serve file: %v", err)
+		abortTest(conn, speedTest.id, "failed to open serve file")
+		return
+	}
+	defer file.Close()
+
+	// Latency and TCP statistics need the WebSocket's pings and socket
+	ws, isWS := conn.(*wsConn)
+	var idleLatency time.Duration
+	haveLatency := false
+	if isWS {
+		idleLatency, haveLatency = measureIdleLatency(ctx, ws)
+	}
+
+	// Retransmits are counted from here, earlier tests may have used the connection
+	var startInfo TCPInfo
+	haveTCPInfo := false
+	if cfg.TCPInfo && isWS {
+		startInfo, haveTCPInfo = tcpInfoOf(ws.UnderlyingConn())
+	}
+
+	// Monitoring under load shares the test's context and ends with the loop
+	loadCtx, stopLoad := context.WithCancel(ctx)
+	defer stopLoad()
+	cpu := monitorCPU(loadCtx)
+	var loadedLatency <-chan time.Duration
+	if haveLatency {
+		loadedLatency = measureLoadedLatency(loadCtx, ws)
+	}
+
+	startMsg := SpeedTestMessage{
+		Type:     "started",
+		ID:       speedTest.id,
+		Duration: duration,
+		Warmup:   speedTest.warmup,
+		// Continuous tests have no set duration
+		DurationMs: max(int64(duration), 0) * 1000,
+		Server:     cfg.ServerName,
+		Label:      speedTest.label,
+	}
+	if err := conn.sendJSON(startMsg); err != nil {
+		log.Printf("Write error: %v", err)
+		return
+	}
+
+	reserveChunk := func() bool {
+		if speedTest.session.reserveBytes(speedTest.chunkSize) {
+			return true
+		}
+		abortTest(conn, speedTest.id, "session transfer limit exceeded")
+		return false
+	}
+
+	// The client is told why the test ended where the connection is still
+	// usable. A WebSocket is closed by a failed chunk, with the reason in the
+	// close frame, so the error message then fails, which is harmless.
+	sendChunk := func(peak *peakMeter) bool {
+		if err := conn.writeTestMessage(file, speedTest.chunkSize, peak); err != nil {
+			log.Printf("Write error: %v", err)
+			abortTest(conn, speedTest.id, "failed to send test data")
+			return false
+		}
+		return true
+	}
+
+	// Warmup data goes over the same connection back to back but is never
+	// sampled, so measurement starts with TCP already up to speed
+	if speedTest.warmup > 0 {
+		warmupEnd := time.Now().Add(time.Duration(speedTest.warmup) * time.Second)
+		for time.Now().Before(warmupEnd) && ctx.Err() == nil {
+			if !reserveChunk() {
 				return
 			}
-
-			// Send test data
-			start := time.Now()
-			if err := conn.WriteMessage(websocket.BinaryMessage, testData); err != nil {
-				log.Printf("Write error: %v", err)
+			if !sendChunk(nil) {
 				return
 			}
+		}
+		if err := conn.sendJSON(SpeedTestMessage{Type: "measuring", ID: speedTest.id}); err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+	}
 
-			// Calculate speed
-			speed := measureSpeed(int64(len(testData)), time.Since(start))
-			speedTest.addSpeed(speed)
-
-			// Send speed update
-			msg := SpeedTestMessage{
-				Type:  "speed",
-				Speed: speed,
+	// Run tests for the specified duration or until stopped
+	continuous := duration == continuousDuration
+	measureStart := time.Now()
+	endTime := measureStart.Add(time.Duration(duration) * time.Second)
+	var pausedFor time.Duration
+	measured := func() time.Duration { return time.Since(measureStart) - pausedFor }
+	var lastUpdate time.Time
+	for (continuous || time.Now().Before(endTime)) && ctx.Err() == nil {
+		if speedTest.isPaused() {
+			pauseStart := time.Now()
+			select {
+			case <-ctx.Done():
+			case <-time.After(pausePollInterval):
 			}
+			// Paused time doesn't count toward the test duration
+			endTime = endTime.Add(time.Since(pauseStart))
+			pausedFor += time.Since(pauseStart)
+			continue
+		}
 
-			if err := conn.WriteJSON(msg); err != nil {
-				log.Printf("Write error: %v", err)
-				return
-			}
+		if !reserveChunk() {
+			return
+		}
+
+		// Send test data
+		start := time.Now()
+		if !sendChunk(speedTest.peak) {
+			return
+		}
+
+		// Calculate speed
+		elapsed := time.Since(start)
+		speed := cfg.plausibleSpeed(measureSpeed(speedTest.chunkSize, elapsed))
+		speedTest.addSpeed(speed, speedTest.chunkSize, elapsed)
+		trace.Logf(ctx, "speed", "%.2f Mbps", speed)
+		if speedTest.stream && time.Since(lastUpdate) < sampleInterval {
+			continue // Every chunk is sampled, but updates are rate limited
+		}
+		lastUpdate = time.Now()
+
+		// Send speed update
+		msg := SpeedTestMessage{
+			Type:      "speed",
+			ID:        speedTest.id,
+			Speed:     cfg.toUnit(speed),
+			Unit:      cfg.Unit,
+			ElapsedMs: measured().Milliseconds(),
+		}
+		if !continuous {
+			msg.EtaSeconds = max(time.Until(endTime).Seconds(), 0)
+		}
+
+		if speedTest.binary {
+			err = ws.sendBinary(msg.encodeSample())
+		} else {
+			err = conn.sendJSON(msg)
+		}
+		if err != nil {
+			log.Printf("Write error: %v", err)
+			return
+		}
+
+		if speedTest.stream {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(sampleInterval):
+		}
+	}
 
-			time.Sleep(500 * time.Millisecond)
+	// Send the final results. Only this goroutine writes them, so a "stop"
+	// yields exactly one final message carrying whatever was measured so far.
+	stopped := ctx.Err() != nil
+	speedTest.stop()
+	stopLoad()
+	cpuBound := cpu.cpuBound()
+	if cpuBound {
+		log.Printf("Warning: CPU was saturated during the test, the result may be CPU-bound rather than network-bound")
+	}
+	headline := speedTest.getHeadline()
+	speedTest.session.addRun(headline)
+	finalMsg := SpeedTestMessage{
+		Type:       "final",
+		ID:         speedTest.id,
+		Duration:   int(measured().Round(time.Second) / time.Second),
+		DurationMs: measured().Milliseconds(),
+		Average:    cfg.toUnit(headline),
+		Min:        cfg.toUnit(speedTest.getMin()),
+		Max:        cfg.toUnit(speedTest.getMax()),
+		Unit:       cfg.Unit,
+		Stopped:    stopped,
+		Server:     cfg.ServerName,
+		CpuBound:   cpuBound,
+		Label:      speedTest.label,
+	}
+	if speedTest.peak != nil {
+		// Chunks sent faster than one window are their own best measurement
+		finalMsg.Peak = cfg.toUnit(max(speedTest.peak.peak, speedTest.getMax()))
+	}
+	stdError, ciLow, ciHigh := speedTest.getConfidence()
+	finalMsg.StdError, finalMsg.CILow, finalMsg.CIHigh = cfg.toUnit(stdError), cfg.toUnit(ciLow), cfg.toUnit(ciHigh)
+	if isWS {
+		if info, ok := tcpInfoOf(ws.UnderlyingConn()); ok {
+			finalMsg.Mss = int(info.Mss)
+			warnSmallMss(conn.remoteAddr(), info)
+			if haveTCPInfo {
+				info.Retransmits -= startInfo.Retransmits
+				finalMsg.TCPInfo = &info
+			}
 		}
+		// SSE data is base64 encoded, so only WebSocket data maps onto segments this simply
+		finalMsg.EstimatedWireMbps = headline * cfg.wireOverhead(finalMsg.Mss)
+	}
+	if haveLatency {
+		finalMsg.LatencyMs = durationMs(idleLatency)
+		if loaded := <-loadedLatency; loaded > 0 {
+			finalMsg.BufferbloatMs = max(durationMs(loaded-idleLatency), 0)
+		}
+	}
+	finalMsg.Score = computeScore(finalMsg, cfg.ReferenceSpeed)
+	finalMsg.Diagnosis = diagnose(finalMsg, speedTest.getTotalBytes())
+	mode := "timed"
+	if continuous {
+		mode = "continuous"
 	}
+	results.record(newResultRecord(conn.remoteAddr(), mode, time.Since(speedTest.startTime), finalMsg))
+	// Ended before sending, so a client starting another test as soon as
+	// it sees the final message is never refused
+	endTest()
+	if err := conn.sendJSON(finalMsg); err != nil {
+		log.Printf("Write error: %v", err)
+		return finalMsg, false
+	}
+	return finalMsg, true
+}
 
-	// Send final average if test completed successfully
-	if speedTest.active {
-		speedTest.stop()
-		finalMsg := SpeedTestMessage{
-			Type:    "final",
-			Average: speedTest.getAverage(),
+// newTestFromStart creates and starts a test as requested by a "start"
+// message, filling unset parameters from defaults and telling sink about
+// any adjusted duration. The test uses the session's Config and is stopped
+// when ctx is done, normally when the request carrying it ends. It returns the
+// test and its duration, or a nil test after telling sink the server is busy
+// when MaxActiveTests are already running.
+func newTestFromStart(ctx context.Context, sink testSink, sess *session, msg, defaults SpeedTestMessage) (*SpeedTest, int) {
+	cfg := sess.cfg
+	// Each test gets fresh state so back-to-back runs never share samples
+	label := msg.Label
+	if label == "" {
+		label = defaults.Label
+	}
+	size := cfg.ChunkSize
+	if msg.ChunkSize > 0 {
+		size = clampSize("chunk size", msg.ChunkSize, cfg.MaxChunkSize)
+	}
+	id := sanitizeID(msg.ID)
+	if id == "" {
+		id = newTestID()
+	}
+	speedTest := &SpeedTest{cfg: cfg, id: id, session: sess, label: sanitizeLabel(label), chunkSize: size, warmup: cfg.Warmup, stream: cfg.Stream}
+	if msg.Stream != nil {
+		speedTest.stream = *msg.Stream
+	}
+	if msg.Warmup > 0 {
+		speedTest.warmup = msg.Warmup
+	}
+	speedTest.warmup = min(speedTest.warmup, maxWarmup)
+	if _, isWS := sink.(*wsConn); isWS && msg.Binary {
+		speedTest.binary = true
+		// Chunks as short as a sample would be mistaken for one
+		speedTest.chunkSize = max(speedTest.chunkSize, binarySampleSize+1)
+	}
+	if msg.Burst {
+		speedTest.peak = &peakMeter{cfg: cfg}
+	}
+	if !activeTests.tryAdd(speedTest, cfg.MaxActiveTests) {
+		abortTest(sink, speedTest.id, "server busy, try again later")
+		return nil, 0
+	}
+	speedTest.start(ctx)
+	duration := msg.Duration
+	if msg.Continuous {
+		duration = continuousDuration
+	}
+	if duration == 0 && defaults.Duration > 0 {
+		duration = defaults.Duration
+	}
+	duration, clamped := cfg.testDuration(duration)
+	if clamped {
+		notice := SpeedTestMessage{
+			Type:       "notice",
+			ID:         speedTest.id,
+			Duration:   duration,
+			DurationMs: int64(duration) * 1000,
+			Message:    fmt.Sprintf("duration adjusted to %d seconds (allowed %d-%d)", duration, cfg.MinDuration, cfg.MaxDuration),
 		}
-		if err := conn.WriteJSON(finalMsg); err != nil {
+		if err := sink.sendJSON(notice); err != nil {
 			log.Printf("Write error: %v", err)
 		}
 	}
+	return speedTest, duration
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	upgraded, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
 		return
 	}
-	defer conn.Close()
+	defer upgraded.Close()
+	connectionsServed.Add(1)
+	conn := &wsConn{Conn: upgraded, cfg: cfg, pongs: make(chan time.Duration, 1), limiter: newRateLimiter(cfg.Throttle)}
+	conn.SetPongHandler(conn.handlePong)
+	conn.SetReadLimit(cfg.MaxMessageSize)
+	cfg.tuneTCPConn(conn.UnderlyingConn())
 
-	speedTest := &SpeedTest{}
+	// Tests run with the request's context, which is cancelled once this
+	// handler returns, so a test stops when its client is gone
+	sess := newSession(cfg)
+	var speedTest *SpeedTest
+	stopSweep := func() {}
+
+	// Parameters in the URL act as defaults that a "start" message can
+	// override. Invalid ones end the session, since every test would be off.
+	defaults, err := parseQueryDefaults(r.URL.Query())
+	if err != nil {
+		if err := conn.sendJSON(SpeedTestMessage{Type: "error", Error: err.Error()}); err != nil {
+			log.Printf("Write error: %v", err)
+		}
+		return
+	}
 
 	for {
 		messageType, message, err := conn.ReadMessage()
@@ -181,26 +1227,256 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if msg.Type == "start" {
-				speedTest.start()
-				duration := msg.Duration
-				if duration == 0 {
-					duration = 10
+				if msg.Version != 0 && msg.Version != protocolVersion {
+					errMsg := SpeedTestMessage{
+						Type:  "error",
+						Error: fmt.Sprintf("unsupported protocol version %d, server speaks version %d", msg.Version, protocolVersion),
+					}
+					if err := conn.sendJSON(errMsg); err != nil {
+						log.Printf("Write error: %v", err)
+					}
+					continue
+				}
+				// Tests on one connection run one at a time, a second start is
+				// rejected until the first has sent its final message
+				if !sess.beginTest() {
+					errMsg := SpeedTestMessage{Type: "error", Error: "a test is already running"}
+					if err := conn.sendJSON(errMsg); err != nil {
+						log.Printf("Write error: %v", err)
+					}
+					continue
+				}
+				if msg.Sweep {
+					sweepCtx, cancel := context.WithCancel(r.Context())
+					stopSweep = cancel
+					go func() {
+						defer cancel()
+						runChunkSweep(sweepCtx, conn, sess, msg, defaults)
+					}()
+					continue
+				}
+				if len(msg.Targets) > 0 {
+					id := sanitizeID(msg.ID)
+					if id == "" {
+						id = newTestID()
+					}
+					if err := cfg.checkPeers(msg.Targets); err != nil {
+						sess.endTest()
+						abortTest(conn, id, err.Error())
+						continue
+					}
+					// Registered like a test, so sweeps count toward
+					// -max-active-tests and are stopped by /admin/stop-all
+					sweep := &SpeedTest{cfg: cfg, id: id, session: sess}
+					if !activeTests.tryAdd(sweep, cfg.MaxActiveTests) {
+						sess.endTest()
+						abortTest(conn, id, "server busy, try again later")
+						continue
+					}
+					sweep.start(r.Context())
+					stopSweep = sweep.stop
+					go func() {
+						defer sess.endTest()
+						defer activeTests.remove(sweep)
+						defer sweep.stop()
+						runSweep(sweep.ctx, conn, cfg, id, msg.Targets)
+					}()
+					continue
+				}
+				var duration int
+				speedTest, duration = newTestFromStart(r.Context(), conn, sess, msg, defaults)
+				if speedTest == nil {
+					sess.endTest()
+					continue
 				}
 				go runSpeedTest(conn, speedTest, duration)
+			} else if msg.Type == "hello" {
+				capabilities := cfg.capabilities()
+				if err := conn.sendJSON(SpeedTestMessage{Type: "hello", Capabilities: &capabilities}); err != nil {
+					log.Printf("Write error: %v", err)
+				}
+			} else if msg.Type == "get_summary" {
+				if err := conn.sendJSON(sess.summary()); err != nil {
+					log.Printf("Write error: %v", err)
+				}
 			} else if msg.Type == "stop" {
-				speedTest.stop()
+				stopSweep()
+				if speedTest != nil {
+					speedTest.stop()
+				}
+			} else if (msg.Type == "pause" || msg.Type == "resume") && speedTest != nil {
+				paused := msg.Type == "pause"
+				if speedTest.setPaused(paused) {
+					status := SpeedTestMessage{Type: "resumed", ID: speedTest.id}
+					if paused {
+						status.Type = "paused"
+					}
+					if err := conn.sendJSON(status); err != nil {
+						log.Printf("Write error: %v", err)
+					}
+				}
 			}
 		}
 	}
 }
 
+// runSelfTest starts s listening on addr, runs a short test against it,
+// checks the average is at least minExpected Mbps and shuts the server down
+// again. A TCP addr may use port 0 to test on an ephemeral port.
+func runSelfTest(s *server, network, addr string, minExpected float64) error {
+	cfg := s.config()
+	// Bind before testing so a port conflict is reported as such
+	listener, server, err := s.listen(network, addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Serve error: %v", err)
+		}
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown error: %v", err)
+		}
+	}()
+
+	hostPort := "localhost"
+	if network != "unix" {
+		hostPort, err = localHostPort(listener.Addr().String())
+		if err != nil {
+			return err
+		}
+	}
+	client := newTestClient(cfg, network, addr)
+	// Interrupting the self-test aborts it rather than waiting out timeouts
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := runClientTest(ctx, client, "ws://"+hostPort+"/ws", selfTestDuration)
+	if err != nil {
+		return err
+	}
+	label := unitLabels[cfg.Unit]
+	fmt.Printf("Self-test: average %.2f %s (min %.2f, max %.2f), latency %.2f ms, bufferbloat %.2f ms, connect %.2f ms%s\n",
+		result.Average, label, result.Min, result.Max, result.LatencyMs, result.BufferbloatMs, durationMs(result.ConnectTime), result.jitterText())
+	if result.Average < cfg.toUnit(minExpected) {
+		return fmt.Errorf("average %.2f %s is below -min-expected %.2f Mbps", result.Average, label, minExpected)
+	}
+
+	httpSpeed, err := runHttpDownloadTest(ctx, client, fmt.Sprintf("http://%s/download?bytes=%d", hostPort, selfTestDownloadBytes))
+	if err != nil {
+		return fmt.Errorf("HTTP download: %w", err)
+	}
+	fmt.Printf("Self-test: HTTP download %.2f %s\n", cfg.toUnit(httpSpeed), label)
+	return nil
+}
+
 func main() {
-	flag.Parse()
+	// The binary serves by default, "serve" may also be given explicitly
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "client" {
+		if err := runClientCommand(args[1:]); err != nil {
+			log.Printf("Client failed: %v", err)
+			if errors.Is(err, errReconnectsExhausted) {
+				os.Exit(exitReconnectsExhausted)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "serve" {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if *configPath != "" {
+		if err := loadFlags(args, *configPath); err != nil {
+			log.Fatalf("Loading -config: %v", err)
+		}
+	}
+
+	cfg := configFromFlags()
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	var resultWriters []io.Writer
+	if *ndjson {
+		w, err := openResultFile(*ndjsonPath)
+		if err != nil {
+			log.Fatalf("Opening -output: %v", err)
+		}
+		resultWriters = append(resultWriters, w)
+	}
+	if cfg.ResultsFile != "" {
+		w, err := openResultFile(cfg.ResultsFile)
+		if err != nil {
+			log.Fatalf("Opening -results-file: %v", err)
+		}
+		resultWriters = append(resultWriters, w)
+	}
+	var summaries io.Writer
+	if *summaryLines {
+		summaries = os.Stdout
+	}
+	if len(resultWriters) > 0 || summaries != nil {
+		results = newResultLog(summaries, resultWriters...)
+		defer results.close()
+	}
+	if *scheduleInterval > 0 && *scheduleTarget == "" {
+		log.Fatal("-schedule requires -schedule-target")
+	}
+	if *scheduleInterval > 0 && len(resultWriters) == 0 {
+		log.Printf("Warning: scheduled results are only logged, set -results-file to keep them")
+	}
 
 	// Start the WebSocket server
-	http.HandleFunc("/ws", handleWebSocket)
-	log.Printf("Starting WebSocket server on %s", *serverAddr)
-	if err := http.ListenAndServe(*serverAddr, nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	s := newServer(cfg)
+	if *selfTest {
+		if err := runSelfTest(s, *network, *serverAddr, *minExpected); err != nil {
+			log.Printf("Self-test failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Bound before serving anything, so a port conflict fails at once
+	listener, server, err := s.listen(*network, *serverAddr)
+	if err != nil && *addrFallback && *network == "tcp" && errors.Is(err, syscall.EADDRINUSE) {
+		log.Printf("Listen: %v, falling back to an ephemeral port", err)
+		listener, server, err = s.listen(*network, ephemeralAddr(*serverAddr))
 	}
-}
\ No newline at end of file
+	if err != nil {
+		log.Printf("Listen: %v", err)
+		os.Exit(exitListenFailed)
+	}
+
+	// Shut down on interrupt so a Unix socket file is cleaned up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutdown error: %v", err)
+		}
+	}()
+
+	if *pprofAddr != "" {
+		go serveProfiling(ctx, *pprofAddr)
+	}
+	if *configPath != "" {
+		go reloadOnHangup(ctx, s, args, *configPath)
+	}
+	if *scheduleInterval > 0 {
+		go runSchedule(ctx, cfg, *scheduleTarget, *scheduleInterval, *scheduleDuration)
+	}
+
+	log.Printf("Starting WebSocket server on %s %s", *network, listener.Addr())
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Fatal("Serve: ", err)
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testConfig returns the default Config with tests short enough to run
+// several per package run
+func testConfig() *Config {
+	cfg := configFromFlags()
+	cfg.MinDuration = 1
+	cfg.ChunkSize = 256 * 1024
+	return cfg
+}
+
+// startServer serves cfg on an ephemeral loopback port until the test ends
+// and returns its host:port
+func startServer(t *testing.T, cfg *Config) string {
+	t.Helper()
+	listener, server, err := newServer(cfg).listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return listener.Addr().String()
+}
+
+// dialTest opens a WebSocket to the server at addr, closed when the test ends
+func dialTest(t *testing.T, addr string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readUntil reads messages from conn, skipping test data, up to and
+// including the first one of type typ, and returns them all
+func readUntil(t *testing.T, conn *websocket.Conn, typ string) []SpeedTestMessage {
+	t.Helper()
+	var msgs []SpeedTestMessage
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", typ, err)
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var msg SpeedTestMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+		if msg.Type == typ {
+			return msgs
+		}
+		if msg.Type == "error" {
+			t.Fatalf("waiting for %q: server error: %s", typ, msg.Error)
+		}
+	}
+}
+
+// runningTest returns the one test in activeTests, waiting for it to start
+func runningTest(t *testing.T) *SpeedTest {
+	t.Helper()
+	for range 100 {
+		activeTests.mu.Lock()
+		for st := range activeTests.tests {
+			activeTests.mu.Unlock()
+			return st
+		}
+		activeTests.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no test started")
+	return nil
+}
+
+// recordingSink is a testSink that keeps the messages sent to it and
+// counts the chunks of test data, which it writes to io.Discard
+type recordingSink struct {
+	cfg    *Config
+	mu     sync.Mutex
+	msgs   []SpeedTestMessage
+	chunks int
+}
+
+func (rs *recordingSink) sendJSON(msg SpeedTestMessage) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.msgs = append(rs.msgs, msg)
+	return nil
+}
+
+func (rs *recordingSink) writeTestMessage(file *loopingFile, size int64, peak *peakMeter) error {
+	rs.mu.Lock()
+	rs.chunks++
+	rs.mu.Unlock()
+	return rs.cfg.writeTestData(io.Discard, file, size)
+}
+
+func (rs *recordingSink) remoteAddr() string {
+	return "recorder"
+}
+
+func TestClientTest(t *testing.T) {
+	cfg := testConfig()
+	addr := startServer(t, cfg)
+
+	result, err := runClientTest(context.Background(), newTestClient(cfg, "tcp", addr), "ws://"+addr+"/ws", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Type != "final" || result.Average <= 0 {
+		t.Errorf("got %s with average %v, want a final with a positive average", result.Type, result.Average)
+	}
+	if n := activeTests.count(); n != 0 {
+		t.Errorf("%d tests still registered after the final message", n)
+	}
+}
+
+func TestTotalBytesMatchesChunksSent(t *testing.T) {
+	cfg := testConfig()
+	sink := &recordingSink{cfg: cfg}
+	st, duration := newTestFromStart(context.Background(), sink, newSession(cfg), SpeedTestMessage{Duration: 1}, SpeedTestMessage{})
+	if st == nil {
+		t.Fatal("test refused")
+	}
+	final, completed := runSpeedTest(sink, st, duration)
+	if !completed {
+		t.Fatalf("test didn't complete, messages %+v", sink.msgs)
+	}
+	if final.Average <= 0 {
+		t.Errorf("average %v, want positive", final.Average)
+	}
+	if sink.chunks == 0 {
+		t.Fatal("no chunks sent")
+	}
+	if got, want := st.getTotalBytes(), int64(sink.chunks)*cfg.ChunkSize; got != want {
+		t.Errorf("getTotalBytes() = %d, want %d for %d chunks", got, want, sink.chunks)
+	}
+}
+
+func TestMeasureSpeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytes    int64
+		duration time.Duration
+		want     float64
+	}{
+		{"one second", 1000000, time.Second, 8},
+		{"half a second", 1000000, 500 * time.Millisecond, 16},
+		{"zero duration", 1000000, 0, 0},
+		{"below measurable", 1000000, minMeasurableDuration - 1, 0},
+	}
+	for _, tt := range tests {
+		if got := measureSpeed(tt.bytes, tt.duration); got != tt.want {
+			t.Errorf("%s: measureSpeed(%d, %v) = %v, want %v", tt.name, tt.bytes, tt.duration, got, tt.want)
+		}
+	}
+}
+
+func TestClientDisconnectEndsTest(t *testing.T) {
+	addr := startServer(t, testConfig())
+	conn := dialTest(t, addr)
+	if err := conn.WriteJSON(SpeedTestMessage{Type: "start", Duration: 30}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "speed")
+	st := runningTest(t)
+	conn.Close()
+
+	// The test leaves the registry as runSpeedTest returns
+	for i := 0; activeTests.count() != 0; i++ {
+		if i == 500 {
+			t.Fatal("test still running 5s after its client went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ctx.Err() == nil {
+		t.Error("test context not cancelled")
+	}
+}
+
+func TestSequentialTestsHaveIndependentResults(t *testing.T) {
+	cfg := testConfig()
+	cfg.FinalMetric = metricMean
+	conn := dialTest(t, startServer(t, cfg))
+
+	for _, id := range []string{"first", "second"} {
+		if err := conn.WriteJSON(SpeedTestMessage{Type: "start", ID: id, Duration: 1}); err != nil {
+			t.Fatal(err)
+		}
+		var speeds []float64
+		var final SpeedTestMessage
+		for _, msg := range readUntil(t, conn, "final") {
+			switch {
+			case msg.ID != id:
+				t.Errorf("%s test got a %s message of test %q", id, msg.Type, msg.ID)
+			case msg.Type == "speed":
+				speeds = append(speeds, msg.Speed)
+			case msg.Type == "final":
+				final = msg
+			}
+		}
+		if len(speeds) == 0 {
+			t.Fatalf("%s test sent no samples", id)
+		}
+		sum, low, high := 0.0, speeds[0], speeds[0]
+		for _, speed := range speeds {
+			sum += speed
+			low, high = min(low, speed), max(high, speed)
+		}
+		// Averages only match the test's own samples if nothing carried over
+		if mean := sum / float64(len(speeds)); math.Abs(final.Average-mean) > 1e-9*mean {
+			t.Errorf("%s test average %v, want %v, the mean of its own %d samples", id, final.Average, mean, len(speeds))
+		}
+		if final.Min != low || final.Max != high {
+			t.Errorf("%s test min %v max %v, want %v and %v", id, final.Min, final.Max, low, high)
+		}
+	}
+}
+
+func TestRapidStartsRunOneTest(t *testing.T) {
+	conn := dialTest(t, startServer(t, testConfig()))
+	for range 2 {
+		if err := conn.WriteJSON(SpeedTestMessage{Type: "start", Duration: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs := readUntil(t, conn, "error")
+	if got := msgs[len(msgs)-1].Error; got != "a test is already running" {
+		t.Errorf("second start got error %q", got)
+	}
+	msgs = append(msgs, readUntil(t, conn, "final")...)
+	started := 0
+	for _, msg := range msgs {
+		if msg.Type == "started" {
+			started++
+		}
+	}
+	if started != 1 {
+		t.Errorf("%d tests started, want 1", started)
+	}
+}
+
+func TestStartChunkSizeIsClamped(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxChunkSize = 64 * 1024
+	st, _ := newTestFromStart(context.Background(), &recordingSink{cfg: cfg}, newSession(cfg), SpeedTestMessage{ChunkSize: 1 << 30}, SpeedTestMessage{})
+	if st == nil {
+		t.Fatal("test refused")
+	}
+	defer activeTests.remove(st)
+	defer st.stop()
+	if st.chunkSize != cfg.MaxChunkSize {
+		t.Errorf("chunk size %d, want -max-chunk-size %d", st.chunkSize, cfg.MaxChunkSize)
+	}
+}
+
+func TestDownloadIsClamped(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxPayload = 1024 * 1024
+	addr := startServer(t, cfg)
+
+	resp, err := http.Get("http://" + addr + "/download?bytes=1000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != cfg.MaxPayload {
+		t.Errorf("downloaded %d bytes, want -max-payload %d", n, cfg.MaxPayload)
+	}
+}
+
+func TestMissingServeFileReportsError(t *testing.T) {
+	cfg := testConfig()
+	cfg.ServeFile = filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(cfg.ServeFile, []byte("test data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Removed after validation, so only opening it for the test fails
+	if err := os.Remove(cfg.ServeFile); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialTest(t, startServer(t, cfg))
+	if err := conn.WriteJSON(SpeedTestMessage{Type: "start", Duration: 1}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readUntil(t, conn, "error")
+	if got := msgs[len(msgs)-1].Error; got != "failed to open serve file" {
+		t.Errorf("got error %q", got)
+	}
+}
+
+func TestActiveTestCap(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxActiveTests = 1
+	addr := startServer(t, cfg)
+	first, second := dialTest(t, addr), dialTest(t, addr)
+
+	if err := first.WriteJSON(SpeedTestMessage{Type: "start", Continuous: true}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, first, "started")
+	if err := second.WriteJSON(SpeedTestMessage{Type: "start", Continuous: true}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readUntil(t, second, "error")
+	if got := msgs[len(msgs)-1].Error; got != "server busy, try again later" {
+		t.Errorf("start over the cap got error %q", got)
+	}
+
+	// The slot is free by the time the final message arrives, so a start
+	// sent right away is accepted
+	if err := first.WriteJSON(SpeedTestMessage{Type: "stop"}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, first, "final")
+	if err := second.WriteJSON(SpeedTestMessage{Type: "start", Continuous: true}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, second, "started")
+	if err := second.WriteJSON(SpeedTestMessage{Type: "stop"}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, second, "final")
+}
+
+func TestSlowChunkOutlastsWriteTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.WriteTimeout = 200 * time.Millisecond
+	cfg.Throttle = 8 // Mbps, so each chunk takes about half a second
+	cfg.ChunkSize = 512 * 1024
+	addr := startServer(t, cfg)
+
+	result, err := runClientTest(context.Background(), newTestClient(cfg, "tcp", addr), "ws://"+addr+"/ws", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Average <= 0 || result.Average > cfg.Throttle*1.5 {
+		t.Errorf("average %v Mbps, want about the %v Mbps throttle", result.Average, cfg.Throttle)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.WSCompress = compress
+		addr := startServer(t, cfg)
+
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial("ws://"+addr+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		negotiated := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		if negotiated != compress {
+			t.Errorf("with -ws-compress=%v permessage-deflate negotiated: %v", compress, negotiated)
+		}
+	}
+}
+
+func TestStreamSendsChunksBackToBack(t *testing.T) {
+	conn := dialTest(t, startServer(t, testConfig()))
+	// countChunks runs a test and returns the chunks of test data it sent
+	countChunks := func(stream bool) int {
+		if err := conn.WriteJSON(SpeedTestMessage{Type: "start", Duration: 1, Stream: &stream}); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		chunks := 0
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg SpeedTestMessage
+			if messageType != websocket.TextMessage {
+				chunks++
+			} else if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			} else if msg.Type == "final" {
+				return chunks
+			}
+		}
+	}
+
+	perChunk, streamed := countChunks(false), countChunks(true)
+	// One chunk per sample interval against as many as fit in the test
+	if maxPerChunk := int(time.Second/sampleInterval) + 1; perChunk > maxPerChunk {
+		t.Errorf("per-chunk test sent %d chunks in 1s, want at most %d", perChunk, maxPerChunk)
+	}
+	if streamed <= 2*perChunk {
+		t.Errorf("streamed test sent %d chunks against %d per chunk, want far more", streamed, perChunk)
+	}
+}
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := []struct{ label, want string }{
+		{"  office 2nd floor ", "office 2nd floor"},
+		{"line\nbreak\r\tand\x1b[31mescape", "linebreakand[31mescape"},
+		{"bidi\u202eoverride\u2028", "bidioverride"},
+		{strings.Repeat("é", maxLabelLength+10), strings.Repeat("é", maxLabelLength)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeLabel(tt.label); got != tt.want {
+			t.Errorf("sanitizeLabel(%q) = %q, want %q", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeID(t *testing.T) {
+	tests := []struct{ id, want string }{
+		{"0b7e6a1c-2f4d-4c8e-9a1b-3c5d7e9f0a2b", "0b7e6a1c-2f4d-4c8e-9a1b-3c5d7e9f0a2b"},
+		{"run_1.host:42", "run_1.host:42"},
+		{"x\nresult avg=1 id=y", "xresultavg1idy"},
+		{"ünïcode", "ncode"},
+		{strings.Repeat("a", maxIDLength+10), strings.Repeat("a", maxIDLength)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeID(tt.id); got != tt.want {
+			t.Errorf("sanitizeID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryDefaults(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"duration=20", 20, false},
+		{"duration=-1", 0, true}, // Continuous tests need a start message asking for one
+		{"duration=0", 0, true},
+		{"duration=ten", 0, true},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defaults, err := parseQueryDefaults(query)
+		if (err != nil) != tt.wantErr || defaults.Duration != tt.want {
+			t.Errorf("parseQueryDefaults(%q) = duration %d, error %v", tt.query, defaults.Duration, err)
+		}
+	}
+}
+
+func TestInvalidQueryDefaultIsReported(t *testing.T) {
+	addr := startServer(t, testConfig())
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws?duration=-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msgs := readUntil(t, conn, "error")
+	if got := msgs[len(msgs)-1].Error; !strings.Contains(got, "invalid duration query parameter") {
+		t.Errorf("got error %q", got)
+	}
+}
+
+func TestFailedChunkIsNotDelivered(t *testing.T) {
+	cfg := testConfig()
+	s := newServer(cfg)
+	// The data source fails part way through the chunk: a pipe can't be
+	// rewound once its data runs out
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgraded, err := s.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer upgraded.Close()
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer pr.Close()
+		go func() {
+			pw.Write(make([]byte, 100*1024))
+			pw.Close()
+		}()
+		conn := &wsConn{Conn: upgraded, cfg: cfg}
+		if err := conn.writeTestMessage(&loopingFile{f: pr}, cfg.ChunkSize, nil); err == nil {
+			t.Error("chunk from a failing source sent without error")
+		}
+		// As in runSpeedTest, the client is then told the test ended, which
+		// must not finish the failed message
+		abortTest(conn, "failing", "failed to send test data")
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn := dialTest(t, listener.Addr().String())
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+				t.Errorf("got %v, want a close with an internal error", err)
+			}
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			t.Errorf("got a data message of %d bytes from a failed chunk of %d", len(data), cfg.ChunkSize)
+		}
+	}
+}
+
+func TestUnansweredPingsDelayStartOnce(t *testing.T) {
+	conn := dialTest(t, startServer(t, testConfig()))
+	conn.SetPingHandler(func(string) error { return nil })
+	start := time.Now()
+	if err := conn.WriteJSON(SpeedTestMessage{Type: "start", Duration: 1}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "started")
+	if waited := time.Since(start); waited > pingTimeout+time.Second {
+		t.Errorf("started after %v, want at most one ping timeout of %v", waited, pingTimeout)
+	}
+	final := readUntil(t, conn, "final")
+	if latency := final[len(final)-1].LatencyMs; latency != 0 {
+		t.Errorf("latency %v ms reported without any pong", latency)
+	}
+}
+
+func TestTransfersRequireToken(t *testing.T) {
+	cfg := testConfig()
+	cfg.Token = "secret"
+	addr := startServer(t, cfg)
+
+	for _, req := range []struct{ method, path string }{{http.MethodGet, "/download?bytes=1024"}, {http.MethodPost, "/upload"}} {
+		r, err := http.NewRequest(req.method, "http://"+addr+req.path, strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s without the token got %s", req.method, req.path, resp.Status)
+		}
+	}
+
+	speed, err := runHttpDownloadTest(context.Background(), newTestClient(cfg, "tcp", addr), "http://"+addr+"/download?bytes=1048576")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if speed <= 0 {
+		t.Errorf("download with the token measured %v Mbps", speed)
+	}
+}
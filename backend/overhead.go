@@ -0,0 +1,15 @@
+package main
+
+// ethernetMtu is the MTU assumed when the platform doesn't report the MSS
+const ethernetMtu = 1500
+
+// wireOverhead returns the factor by which bytes on the wire exceed the
+// data carried, for segments of mss bytes each wrapped in HeaderBytes of
+// TCP/IP headers and FrameOverhead bytes of link framing. An mss of 0 means
+// unknown and assumes full Ethernet frames.
+func (c *Config) wireOverhead(mss int) float64 {
+	if mss <= 0 {
+		mss = ethernetMtu - c.HeaderBytes
+	}
+	return float64(mss+c.HeaderBytes+c.FrameOverhead) / float64(mss)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime/trace"
+	"sync/atomic"
+)
+
+// serveProfiling serves net/http/pprof on addr until ctx is done. It listens
+// separately from the tests, so profiles are never exposed on their port.
+func serveProfiling(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Profiling listen error: %v", err)
+		return
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Serving profiles on http://%s/debug/pprof/", listener.Addr())
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("Profiling serve error: %v", err)
+	}
+}
+
+// tracing is set while a test is being traced. The runtime writes one
+// execution trace at a time.
+var tracing atomic.Bool
+
+// startTrace writes an execution trace to path, replacing the file, until
+// the returned function is called. Tests starting while another test is
+// traced aren't traced, and neither is any test when path is empty.
+func startTrace(path, id string) (stop func()) {
+	if path == "" || !tracing.CompareAndSwap(false, true) {
+		return func() {}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Trace error: %v", err)
+		tracing.Store(false)
+		return func() {}
+	}
+	if err := trace.Start(f); err != nil {
+		log.Printf("Trace error: %v", err)
+		f.Close()
+		tracing.Store(false)
+		return func() {}
+	}
+	log.Printf("Tracing test %s to %s", id, path)
+	return func() {
+		trace.Stop()
+		if err := f.Close(); err != nil {
+			log.Printf("Trace error: %v", err)
+		}
+		tracing.Store(false)
+	}
+}
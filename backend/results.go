@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ResultRecord is a completed test as written to result logs
+type ResultRecord struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client,omitempty"` // Client IP address, empty for scheduled tests
+	Target   string    `json:"target,omitempty"` // Server tested, for scheduled tests run by this server
+	Mode     string    `json:"mode"`             // "timed", "continuous" or "scheduled"
+	Duration float64   `json:"duration"`         // Seconds the test actually ran
+	// Direction of the test data as seen by the client, which for
+	// scheduled tests is this server: "download" from the server tested
+	Direction string `json:"direction,omitempty"`
+	// Jitter in ms of data arrival, for scheduled tests with -measure-jitter
+	DataJitter float64 `json:"dataJitter,omitempty"`
+	SpeedTestMessage
+}
+
+// newResultRecord describes the final message of a test run for the client at remoteAddr
+func newResultRecord(remoteAddr string, mode string, elapsed time.Duration, final SpeedTestMessage) ResultRecord {
+	client := remoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return ResultRecord{
+		Time:             time.Now(),
+		Client:           client,
+		Mode:             mode,
+		Direction:        "download",
+		Duration:         elapsed.Seconds(),
+		SpeedTestMessage: final,
+	}
+}
+
+// summaryLine formats rec as one line of space-separated key=value pairs
+// for log scrapers, e.g.
+//
+//	result avg=940.20 min=901.33 max=962.10 unit=mbps dur=10.0 mode=timed ip=192.0.2.7 id=...
+//
+// Keys with empty values are left out. Values that aren't plain words are
+// quoted, see summaryValue, so a line always ends up as one record.
+func summaryLine(rec ResultRecord) string {
+	fields := []string{
+		"result",
+		"avg=" + strconv.FormatFloat(rec.Average, 'f', 2, 64),
+		"min=" + strconv.FormatFloat(rec.Min, 'f', 2, 64),
+		"max=" + strconv.FormatFloat(rec.Max, 'f', 2, 64),
+		"unit=" + rec.Unit,
+		"dur=" + strconv.FormatFloat(rec.Duration, 'f', 1, 64),
+		"mode=" + rec.Mode,
+	}
+	if rec.Client != "" {
+		fields = append(fields, "ip="+rec.Client)
+	}
+	if rec.Target != "" {
+		fields = append(fields, "target="+summaryValue(rec.Target))
+	}
+	if rec.ID != "" {
+		fields = append(fields, "id="+summaryValue(rec.ID))
+	}
+	if rec.Stopped {
+		fields = append(fields, "stopped=true")
+	}
+	return strings.Join(fields, " ")
+}
+
+// summaryValue returns v as a summary line value, quoted with strconv.Quote
+// if it is empty or has spaces, quotes, '=' or unprintable characters, so a
+// client supplied ID can't end the line or fake further fields or records
+func summaryValue(v string) string {
+	plain := v != "" && !strings.ContainsFunc(v, func(r rune) bool {
+		return !unicode.IsGraphic(r) || unicode.IsSpace(r) || r == '=' || r == '"'
+	})
+	if plain {
+		return v
+	}
+	return strconv.Quote(v)
+}
+
+// resultLog writes one JSON object per line for each completed test, and
+// optionally a summary line. A single goroutine does the writing, so
+// records from concurrent tests never interleave.
+type resultLog struct {
+	records   chan ResultRecord
+	closing   chan struct{}
+	done      chan struct{}
+	encoders  []*json.Encoder
+	summaries io.Writer // Receives a summaryLine per record, nil for none
+}
+
+// results is nil unless a result output is configured
+var results *resultLog
+
+// newResultLog starts a log writing every record to each of writers, and
+// a summary line to summaries if it isn't nil
+func newResultLog(summaries io.Writer, writers ...io.Writer) *resultLog {
+	rl := &resultLog{
+		records:   make(chan ResultRecord, 64),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+		summaries: summaries,
+	}
+	for _, w := range writers {
+		rl.encoders = append(rl.encoders, json.NewEncoder(w))
+	}
+	go rl.run()
+	return rl
+}
+
+// openResultFile opens path for appending results, or returns stdout if path is empty
+func openResultFile(path string) (io.Writer, error) {
+	if path == "" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+func (rl *resultLog) run() {
+	defer close(rl.done)
+	for {
+		select {
+		case rec := <-rl.records:
+			rl.write(rec)
+		case <-rl.closing:
+			// Write whatever was queued before closing
+			for {
+				select {
+				case rec := <-rl.records:
+					rl.write(rec)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (rl *resultLog) write(rec ResultRecord) {
+	for _, enc := range rl.encoders {
+		if err := enc.Encode(rec); err != nil {
+			log.Printf("Result log error: %v", err)
+		}
+	}
+	if rl.summaries != nil {
+		if _, err := fmt.Fprintln(rl.summaries, summaryLine(rec)); err != nil {
+			log.Printf("Result log error: %v", err)
+		}
+	}
+}
+
+// record queues rec to be written. Records arriving after close are dropped.
+func (rl *resultLog) record(rec ResultRecord) {
+	if rl == nil {
+		return
+	}
+	select {
+	case rl.records <- rec:
+	case <-rl.closing:
+	}
+}
+
+// close writes any queued records and stops the log
+func (rl *resultLog) close() {
+	if rl == nil {
+		return
+	}
+	close(rl.closing)
+	<-rl.done
+}
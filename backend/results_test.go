@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSummaryLineQuotesHostileID(t *testing.T) {
+	rec := ResultRecord{Mode: "timed", SpeedTestMessage: SpeedTestMessage{ID: "x\nresult avg=1\r\tid=y", Unit: unitMbps}}
+	line := summaryLine(rec)
+	if strings.ContainsAny(line, "\n\r\t") {
+		t.Fatalf("summary line %q contains a line break or tab", line)
+	}
+	if want := ` id="x\nresult avg=1\r\tid=y"`; !strings.HasSuffix(line, want) {
+		t.Errorf("summary line %q, want it to end with %s", line, want)
+	}
+
+	rec.ID = "plain-id"
+	if line := summaryLine(rec); !strings.HasSuffix(line, " id=plain-id") {
+		t.Errorf("summary line %q, want a plain ID left unquoted", line)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runSchedule runs a test of duration seconds against the server at target
+// every interval until ctx is cancelled, recording each result like an
+// on-demand test. Connections use the client settings of cfg.
+func runSchedule(ctx context.Context, cfg *Config, target string, interval time.Duration, duration int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Leave the link to on-demand tests, whose results matter more
+		if n := activeTests.count(); n > 0 {
+			log.Printf("Skipping scheduled test of %s, %d tests running", target, n)
+			continue
+		}
+		runScheduledTest(ctx, cfg, target, interval, duration)
+	}
+}
+
+// runScheduledTest runs one test against target, within interval so runs never overlap
+func runScheduledTest(ctx context.Context, cfg *Config, target string, interval time.Duration, duration int) {
+	ctx, cancel := context.WithTimeout(ctx, interval)
+	defer cancel()
+
+	start := time.Now()
+	result, err := runClientTest(ctx, newTestClient(cfg, "tcp", ""), "ws://"+target+"/ws", duration)
+	if err != nil {
+		log.Printf("Scheduled test of %s failed: %v", target, err)
+		return
+	}
+	log.Printf("Scheduled test of %s: average %.2f %s (min %.2f, max %.2f)%s",
+		target, result.Average, unitLabels[result.Unit], result.Min, result.Max, result.jitterText())
+
+	rec := ResultRecord{
+		Time:             time.Now(),
+		Target:           target,
+		Mode:             "scheduled",
+		Direction:        "download",
+		Duration:         time.Since(start).Seconds(),
+		DataJitter:       result.DataJitter,
+		SpeedTestMessage: result.SpeedTestMessage,
+	}
+	results.record(rec)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// messageTypes are the values of SpeedTestMessage.Type, described on SpeedTestMessage
+var messageTypes = []string{
+	"start", "stop", "pause", "resume", "get_summary", "hello",
+	"started", "measuring", "speed", "paused", "resumed", "final", "summary",
+	"notice", "error", "target", "sweep", "chunk_result", "chunk_sweep",
+}
+
+// jsonSchema returns a JSON Schema describing how encoding/json encodes
+// values of t. Fields without omitempty are required.
+func jsonSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]any)
+		required := []string{}
+		addStructFields(t, properties, &required)
+		return map[string]any{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]any{}
+}
+
+// addStructFields adds the JSON encoded fields of the struct type t to
+// properties, including those of embedded structs
+func addStructFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(f.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = jsonSchema(f.Type)
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// handleSchema describes SpeedTestMessage as a JSON Schema generated from
+// the struct, so clients can keep up as fields are added
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	schema := jsonSchema(reflect.TypeFor[SpeedTestMessage]())
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "SpeedTestMessage"
+	schema["description"] = "A message exchanged over /ws and streamed by /events, see the protocol version in version"
+	schema["properties"].(map[string]any)["type"] = map[string]any{"type": "string", "enum": messageTypes}
+	writeJSON(w, schema)
+}
@@ -0,0 +1,40 @@
+package main
+
+import "math"
+
+// Weights of each metric in a score, out of 100
+const (
+	scoreSpeedWeight   = 60
+	scoreLatencyWeight = 25
+	scoreJitterWeight  = 15
+)
+
+// Latency and jitter in milliseconds at which their parts of a score halve
+const (
+	scoreHalfLatencyMs = 20
+	scoreHalfJitterMs  = 20
+)
+
+// computeScore summarizes a final message as one number from 0 to 100 for
+// users who don't want to read the raw metrics. Each metric is rated from 0
+// to 1 and the ratings are weighted:
+//
+//	speed   min(average / ref, 1)        weight 60
+//	latency 20 / (20 + latencyMs)        weight 25
+//	jitter  20 / (20 + bufferbloatMs)    weight 15
+//
+// ref is the speed in Mbps that earns full marks. Jitter is the increase in
+// round trip time under load, the variation in latency a test measures. Tests
+// without latency measurements, such as over /events, are scored on speed
+// alone.
+func computeScore(final SpeedTestMessage, ref float64) int {
+	mbps := final.Average / unitScales[final.Unit]
+	score := scoreSpeedWeight * min(mbps/ref, 1)
+	weights := float64(scoreSpeedWeight)
+	if final.LatencyMs > 0 {
+		score += scoreLatencyWeight * scoreHalfLatencyMs / (scoreHalfLatencyMs + final.LatencyMs)
+		score += scoreJitterWeight * scoreHalfJitterMs / (scoreHalfJitterMs + final.BufferbloatMs)
+		weights += scoreLatencyWeight + scoreJitterWeight
+	}
+	return int(math.Round(score / weights * 100))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// server serves tests and the HTTP API according to its current Config,
+// which setConfig may replace while serving
+type server struct {
+	cfg      atomic.Pointer[Config]
+	upgrader websocket.Upgrader
+}
+
+func newServer(cfg *Config) *server {
+	s := &server{
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:    cfg.WSReadBuffer,
+			WriteBufferSize:   cfg.WSWriteBuffer,
+			EnableCompression: cfg.WSCompress,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+	}
+	s.cfg.Store(cfg)
+	return s
+}
+
+// config returns the current Config. Requests and tests load it once when
+// they begin and keep using it to the end, even if it is replaced meanwhile.
+func (s *server) config() *Config {
+	return s.cfg.Load()
+}
+
+// setConfig replaces the Config used by requests and tests begun from now
+// on. The WebSocket buffers and compression are fixed when the server is
+// created, so they keep their old values and changes to them are logged as
+// ignored. A new -read-timeout only applies to request headers on HTTP
+// servers created afterwards.
+func (s *server) setConfig(cfg *Config) {
+	old := s.config()
+	ignored := func(name string) {
+		log.Printf("Ignoring change to -%s, restart the server to apply it", name)
+	}
+	if cfg.WSCompress != old.WSCompress {
+		ignored("ws-compress")
+		cfg.WSCompress = old.WSCompress
+	}
+	if cfg.WSReadBuffer != old.WSReadBuffer {
+		ignored("ws-read-buffer")
+		cfg.WSReadBuffer = old.WSReadBuffer
+	}
+	if cfg.WSWriteBuffer != old.WSWriteBuffer {
+		ignored("ws-write-buffer")
+		cfg.WSWriteBuffer = old.WSWriteBuffer
+	}
+	s.cfg.Store(cfg)
+}
+
+// handler returns a mux serving all of the server's endpoints
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.requireToken(s.handleWebSocket, true))
+	mux.HandleFunc("/events", allowCORS(s.requireToken(s.handleEvents, true)))
+	mux.HandleFunc("/download", allowCORS(s.requireToken(s.handleDownload, true)))
+	mux.HandleFunc("/upload", allowCORS(s.requireToken(s.handleUpload, true)))
+	mux.HandleFunc("/admin/stop-all", s.handleStopAll)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/stats", allowCORS(handleStats))
+	mux.HandleFunc("/schema", allowCORS(handleSchema))
+	mux.HandleFunc("/api/aggregate", allowCORS(s.requireToken(s.handleAggregate, false)))
+	mux.HandleFunc("/api/compare", allowCORS(s.requireToken(handleCompare, false)))
+	mux.HandleFunc("/api/capabilities", allowCORS(s.requireToken(s.handleCapabilities, false)))
+	mux.HandleFunc("/api/history.csv", allowCORS(s.requireToken(s.handleHistoryCSV, false)))
+	return mux
+}
+
+// newHTTPServer returns an HTTP server for the server's endpoints with
+// ReadTimeout applied to request headers. Bodies and WebSocket sessions are
+// long-lived, so their deadlines are set per read or write instead.
+func (s *server) newHTTPServer() *http.Server {
+	return &http.Server{Handler: s.handler(), ReadHeaderTimeout: s.config().ReadTimeout}
+}
+
+// listen binds addr and returns the listener with an HTTP server to pass it
+// to. The kernel queues connections from the moment listen returns, so
+// clients may dial right away, even before Serve is called, without polling
+// or sleeping until the server is up. A TCP addr with port 0 binds an
+// ephemeral port, which the listener's Addr reports.
+func (s *server) listen(network, addr string) (net.Listener, *http.Server, error) {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listener, s.newHTTPServer(), nil
+}
+
+// ephemeralAddr returns the TCP addr with its port replaced by 0, so
+// listening on it binds an ephemeral port on the same host
+func ephemeralAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = ""
+	}
+	return net.JoinHostPort(host, "0")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sseLineLength is the longest comment line test data is split into, so
+// EventSource parsers never have to buffer a whole chunk as one line
+const sseLineLength = 4096
+
+// sseSink streams a test to a browser as Server-Sent Events. Messages are
+// sent as the data of unnamed events. Test data is sent base64 encoded in
+// comment lines, which EventSource ignores. Speeds count the data before
+// encoding, so the wire carries a third more than is reported.
+type sseSink struct {
+	cfg     *Config
+	w       io.Writer
+	rc      *http.ResponseController
+	addr    string
+	limiter *rateLimiter // Throttles test data, nil when unlimited
+}
+
+func (s *sseSink) remoteAddr() string {
+	return s.addr
+}
+
+// sendJSON sends msg stamped with the protocol version as one event
+func (s *sseSink) sendJSON(msg SpeedTestMessage) error {
+	msg.Version = protocolVersion
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := s.rc.SetWriteDeadline(deadline(s.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(s.w, "data: "+string(data)+"\n\n"); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// writeTestMessage sends one chunk of test data as comment lines, measured
+// by peak if it isn't nil
+func (s *sseSink) writeTestMessage(file *loopingFile, size int64, peak *peakMeter) error {
+	if err := s.rc.SetWriteDeadline(deadline(s.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	lines := &sseCommentWriter{w: &deadlineWriter{w: s.w, setDeadline: s.rc.SetWriteDeadline, timeout: s.cfg.WriteTimeout}}
+	enc := base64.NewEncoder(base64.StdEncoding, lines)
+	dst := s.limiter.writer(enc)
+	if peak != nil {
+		dst = peak.wrap(dst)
+	}
+	// The open line is ended even after a failure, so an error event sent
+	// next isn't swallowed by the comment
+	err := s.cfg.writeTestData(dst, file, size)
+	if err == nil {
+		err = enc.Close()
+	}
+	if endErr := lines.end(); err == nil {
+		err = endErr
+	}
+	if err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// sseCommentWriter writes text as SSE comment lines of at most sseLineLength bytes
+type sseCommentWriter struct {
+	w       io.Writer
+	lineLen int // Bytes written to the current line, 0 if no line is open
+}
+
+func (cw *sseCommentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if cw.lineLen == 0 {
+			if _, err := io.WriteString(cw.w, ":"); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), sseLineLength-cw.lineLen)
+		if _, err := cw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		cw.lineLen += n
+		if cw.lineLen == sseLineLength {
+			if err := cw.end(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// end terminates the open line, if any
+func (cw *sseCommentWriter) end() error {
+	if cw.lineLen == 0 {
+		return nil
+	}
+	cw.lineLen = 0
+	_, err := io.WriteString(cw.w, "\n")
+	return err
+}
+
+// handleEvents runs one test and streams its messages as Server-Sent Events
+// for clients that can't use a WebSocket. The query parameters duration,
+// warmup, continuous, stream, burst, label and chunkSize take the place of a
+// "start" message.
+// The test ends early when the client disconnects.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	if r.Method != http.MethodGet {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	connectionsServed.Add(1)
+	query := r.URL.Query()
+	defaults, err := parseQueryDefaults(query)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_duration", err.Error())
+		return
+	}
+	msg := SpeedTestMessage{Type: "start"}
+	msg.Continuous, _ = strconv.ParseBool(query.Get("continuous"))
+	msg.Burst, _ = strconv.ParseBool(query.Get("burst"))
+	msg.Warmup, _ = strconv.Atoi(query.Get("warmup"))
+	if v, err := strconv.ParseBool(query.Get("stream")); err == nil {
+		msg.Stream = &v
+	}
+	if v := query.Get("chunkSize"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid_chunk_size", "invalid chunkSize parameter")
+			return
+		}
+		msg.ChunkSize = size
+	}
+
+	// Keep proxies from buffering the stream, which would delay every event
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store, no-transform")
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+	defer rc.SetWriteDeadline(time.Time{})
+	sink := &sseSink{cfg: cfg, w: w, rc: rc, addr: r.RemoteAddr, limiter: newRateLimiter(cfg.Throttle)}
+
+	sess := newSession(cfg)
+	sess.beginTest()
+	// The test stops when the browser closes the stream and cancels the request
+	speedTest, duration := newTestFromStart(r.Context(), sink, sess, msg, defaults)
+	if speedTest == nil {
+		return
+	}
+	runSpeedTest(sink, speedTest, duration)
+}
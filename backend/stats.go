@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Final metrics selectable with -final-metric for the headline average
+const (
+	metricMean     = "mean"
+	metricWeighted = "weighted" // Total bits over total seconds, weighting samples by the time they cover
+	metricMedian   = "median"
+	metricTrimmed  = "trimmed" // Mean after dropping the top and bottom trimFraction
+	metricP95      = "p95"
+)
+
+const trimFraction = 0.1
+
+// z95 is the two-sided 95% critical value of the normal distribution. Tests
+// produce enough samples that it is close to the t distribution's.
+const z95 = 1.96
+
+// validateMetric reports an error if metric is not a known final metric
+func validateMetric(metric string) error {
+	switch metric {
+	case metricMean, metricWeighted, metricMedian, metricTrimmed, metricP95:
+		return nil
+	}
+	return fmt.Errorf("unknown final metric %q", metric)
+}
+
+// mean returns the arithmetic mean of values
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// percentile returns the p-th percentile (0-100) of sorted values using
+// linear interpolation between the closest ranks
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
+}
+
+// trimmedMean returns the mean of sorted values after dropping fraction of
+// the samples from each end
+func trimmedMean(sorted []float64, fraction float64) float64 {
+	trim := int(float64(len(sorted)) * fraction)
+	return mean(sorted[trim : len(sorted)-trim])
+}
+
+// summarize reduces samples to a single number according to metric
+func summarize(samples []float64, metric string) float64 {
+	if metric == metricMean {
+		return mean(samples)
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	switch metric {
+	case metricMedian:
+		return percentile(sorted, 50)
+	case metricTrimmed:
+		return trimmedMean(sorted, trimFraction)
+	case metricP95:
+		return percentile(sorted, 95)
+	}
+	return mean(samples)
+}
+
+// sampleRing retains the most recent samples up to its capacity while
+// keeping running statistics over every sample added. The mean, min and
+// max cover the whole test, but percentile-based metrics can only reflect
+// the retained window.
+type sampleRing struct {
+	buf      []float64
+	capacity int
+	next     int // Index the next sample overwrites once buf is full
+
+	count    int
+	sum      float64
+	m2       float64 // Sum of squared differences from the mean, kept with Welford's method
+	min, max float64
+}
+
+func newSampleRing(capacity int) sampleRing {
+	return sampleRing{capacity: max(capacity, 1)}
+}
+
+func (r *sampleRing) add(v float64) {
+	if len(r.buf) < r.capacity {
+		r.buf = append(r.buf, v)
+	} else {
+		r.buf[r.next] = v
+		r.next = (r.next + 1) % r.capacity
+	}
+
+	if r.count == 0 || v < r.min {
+		r.min = v
+	}
+	if r.count == 0 || v > r.max {
+		r.max = v
+	}
+	delta := v - r.mean()
+	r.count++
+	r.sum += v
+	r.m2 += delta * (v - r.mean())
+}
+
+// values returns the retained samples, oldest first
+func (r *sampleRing) values() []float64 {
+	return append(slices.Clone(r.buf[r.next:]), r.buf[:r.next]...)
+}
+
+func (r *sampleRing) mean() float64 {
+	if r.count == 0 {
+		return 0
+	}
+	return r.sum / float64(r.count)
+}
+
+// stdDev returns the sample standard deviation, which is zero for fewer
+// than two samples, where it is undefined
+func (r *sampleRing) stdDev() float64 {
+	if r.count < 2 {
+		return 0
+	}
+	return math.Sqrt(r.m2 / float64(r.count-1))
+}
+
+// stdError returns the standard error of the mean, the sample standard
+// deviation over the square root of the count
+func (r *sampleRing) stdError() float64 {
+	return r.stdDev() / math.Sqrt(float64(max(r.count, 1)))
+}
+
+// confidenceInterval returns the bounds of the 95% confidence interval of
+// the mean, which has zero width for fewer than two samples
+func (r *sampleRing) confidenceInterval() (low, high float64) {
+	margin := z95 * r.stdError()
+	return r.mean() - margin, r.mean() + margin
+}
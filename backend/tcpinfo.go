@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// minExpectedMss is the smallest MSS expected on a LAN. Ethernet gives
+// 1460 bytes over IPv4, and tunnels or PPPoE somewhat less. Much smaller
+// segments point at a misconfigured MTU, such as a jumbo frame mismatch
+// forcing fragmentation or a path MTU fallback.
+const minExpectedMss = 1200
+
+// TCPInfo is the kernel's view of a test connection, reported with -tcp-info
+type TCPInfo struct {
+	RttMs       float64 `json:"rttMs"`       // Smoothed round trip time
+	RttVarMs    float64 `json:"rttVarMs"`    // Round trip time variation
+	Retransmits uint32  `json:"retransmits"` // Segments retransmitted during the test
+	SndCwnd     uint32  `json:"sndCwnd"`     // Congestion window in segments
+	Mss         uint32  `json:"mss"`         // Maximum segment size sent, in bytes
+	PathMtu     uint32  `json:"pathMtu"`     // Path MTU the kernel discovered, in bytes
+}
+
+// tcpInfoOf returns the TCP_INFO of conn, or false if it isn't a TCP
+// connection or the platform doesn't support it
+func tcpInfoOf(conn net.Conn) (TCPInfo, bool) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return TCPInfo{}, false
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return TCPInfo{}, false
+	}
+	info, err := readTCPInfo(raw)
+	if err != nil {
+		return TCPInfo{}, false
+	}
+	return info, true
+}
+
+// warnSmallMss logs a warning if the connection to remoteAddr uses segments
+// smaller than minExpectedMss, which throughput alone wouldn't reveal
+func warnSmallMss(remoteAddr string, info TCPInfo) {
+	if info.Mss > 0 && info.Mss < minExpectedMss {
+		log.Printf("Warning: MSS to %s is only %d bytes (path MTU %d), check the MTU settings along the path",
+			remoteAddr, info.Mss, info.PathMtu)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build linux && !386
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// readTCPInfo reads TCP_INFO from the socket c. Retransmits is the total
+// over the connection's lifetime.
+func readTCPInfo(c syscall.RawConn) (TCPInfo, error) {
+	var info syscall.TCPInfo
+	size := uint32(syscall.SizeofTCPInfo)
+	var errno syscall.Errno
+	err := c.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return TCPInfo{}, err
+	}
+	if errno != 0 {
+		return TCPInfo{}, errno
+	}
+	return TCPInfo{
+		RttMs:       float64(info.Rtt) / 1000, // Microseconds
+		RttVarMs:    float64(info.Rttvar) / 1000,
+		Retransmits: info.Total_retrans,
+		SndCwnd:     info.Snd_cwnd,
+		Mss:         info.Snd_mss,
+		PathMtu:     info.Pmtu,
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux || 386
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// readTCPInfo is not supported on this platform
+func readTCPInfo(c syscall.RawConn) (TCPInfo, error) {
+	return TCPInfo{}, errors.ErrUnsupported
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// throttleSlack is how much unused rate a throttled connection may catch up
+// on after sleeping longer than it asked to
+const throttleSlack = 2 * time.Millisecond
+
+// rateLimiter is a token bucket limiting one connection to a fixed rate,
+// to simulate a slower link. It sleeps in the goroutine doing the I/O and
+// has no goroutine of its own. A nil rateLimiter doesn't limit anything.
+type rateLimiter struct {
+	bytesPerSecond float64
+	tokens         float64 // Bytes that may be sent now, negative when in debt
+	last           time.Time
+}
+
+// newRateLimiter returns a limiter to mbps, or nil if mbps isn't positive
+func newRateLimiter(mbps float64) *rateLimiter {
+	if mbps <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: mbps * 1000000 / 8, last: time.Now()}
+}
+
+// wait blocks until n more bytes fit the rate
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	// A slow link can't save up the capacity it left unused between chunks,
+	// so the bucket only holds enough to make up for sleeps overshooting
+	burst := max(2*blockSize, l.bytesPerSecond*throttleSlack.Seconds())
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.bytesPerSecond, burst)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.bytesPerSecond * float64(time.Second)))
+	}
+}
+
+// writer returns w limited to the rate, or w itself for a nil limiter
+func (l *rateLimiter) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &throttledWriter{w: w, l: l}
+}
+
+// reader returns r limited to the rate, or r itself for a nil limiter
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, l: l}
+}
+
+type throttledWriter struct {
+	w io.Writer
+	l *rateLimiter
+}
+
+// Write waits for the rate before each piece of up to blockSize bytes, so
+// large writes are paced rather than sent in one burst
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p[:min(len(p), blockSize)]
+		tw.l.wait(len(piece))
+		n, err := tw.w.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+// Read waits after each read for the rate, which holds back the next read
+// and, through TCP flow control, the sender
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.l.wait(n)
+	return n, err
+}
@@ -0,0 +1,47 @@
+package main
+
+import "fmt"
+
+// Units selectable with -unit for the speeds reported to clients. Speeds
+// are always measured and kept in Mbps and only converted when reported.
+const (
+	unitMbps            = "mbps"
+	unitGbps            = "gbps"
+	unitMBytesPerSecond = "mbyteps" // Megabytes per second
+)
+
+// unitScales converts a speed in Mbps to each unit
+var unitScales = map[string]float64{
+	unitMbps:            1,
+	unitGbps:            1.0 / 1000,
+	unitMBytesPerSecond: 1.0 / 8,
+}
+
+// unitLabels are the human-readable names of each unit
+var unitLabels = map[string]string{
+	unitMbps:            "Mbps",
+	unitGbps:            "Gbps",
+	unitMBytesPerSecond: "MB/s",
+}
+
+// validateUnit reports an error if unit is not a known unit
+func validateUnit(unit string) error {
+	if _, ok := unitScales[unit]; !ok {
+		return fmt.Errorf("unknown unit %q", unit)
+	}
+	return nil
+}
+
+// toUnit converts a speed in Mbps to the configured unit
+func (c *Config) toUnit(mbps float64) float64 {
+	return mbps * unitScales[c.Unit]
+}
+
+// toMbps converts a speed reported in unit back to Mbps. Results recorded
+// before -unit existed carry no unit and are already in Mbps.
+func toMbps(speed float64, unit string) float64 {
+	if unit == "" {
+		return speed
+	}
+	return speed / unitScales[unit]
+}
@@ -4,6 +4,9 @@ type SpeedUnit = "bits" | "bytes";
 type TestDuration = 5 | 10 | 15 | 25;
 type TestState = "idle" | "connecting" | "running" | "complete";
 
+// Factors converting each server -unit back to Mbps, which the display assumes
+const toMbps: Record<string, number> = { mbps: 1, gbps: 1000, mbyteps: 8 };
+
 // Add Timer type to fix NodeJS namespace error
 type Timer = ReturnType<typeof setInterval>;
 
@@ -29,7 +32,10 @@ function App() {
 
       // Get the hostname from the current window location
       const hostname = window.location.hostname;
-      wsRef.current = new WebSocket(`ws://${hostname}:8080/ws`);
+      // Pass along a token from the page URL for servers started with -token
+      const token = new URLSearchParams(window.location.search).get("token");
+      const query = token ? `?token=${encodeURIComponent(token)}` : "";
+      wsRef.current = new WebSocket(`ws://${hostname}:8080/ws${query}`);
 
       wsRef.current.onopen = () => {
         isConnected.current = true;
@@ -50,12 +56,13 @@ function App() {
 
       wsRef.current.onmessage = (event) => {
         const data = JSON.parse(event.data);
+        const scale = toMbps[data.unit] ?? 1;
 
         if (data.type === "speed") {
-          setCurrentSpeed(data.speed);
-          speeds.current.push(data.speed);
+          setCurrentSpeed(data.speed * scale);
+          speeds.current.push(data.speed * scale);
         } else if (data.type === "final") {
-          setAverageSpeed(data.average);
+          setAverageSpeed(data.average * scale);
           setTestState("complete");
           if (progressInterval.current) {
             clearInterval(progressInterval.current);
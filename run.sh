@@ -43,7 +43,7 @@ echo "Starting WebSocket server..."
 echo "WebSocket server: $LOCAL_IP$WS_PORT"
 echo "Chunk size: $((CHUNK_SIZE/1024/1024))MB"
 
-cd backend && go run main.go \
+cd backend && go run . serve \
   -addr="$WS_PORT" \
   -chunk-size="$CHUNK_SIZE" &
 BACKEND_PID=$!